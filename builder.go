@@ -0,0 +1,89 @@
+package xmlrpc
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// CallBuilder configures and executes a single method call.
+//
+//	v, err := NewCallBuilder().Method("blog.getPost").Args(42).Timeout(time.Second).Execute(url)
+type CallBuilder struct {
+	client  *http.Client
+	name    string
+	args    []interface{}
+	timeout time.Duration
+	header  http.Header
+	retry   int
+	backoff BackoffFunc
+}
+
+// NewCallBuilder returns a CallBuilder using the same HTTP client as Call.
+func NewCallBuilder() *CallBuilder {
+	return &CallBuilder{
+		client:  defaultClient,
+		header:  make(http.Header),
+		backoff: ExponentialBackoff(100*time.Millisecond, 5*time.Second),
+	}
+}
+
+// Method sets the name of the method to call.
+func (b *CallBuilder) Method(name string) *CallBuilder {
+	b.name = name
+	return b
+}
+
+// Args appends args to the parameters of the call.
+func (b *CallBuilder) Args(args ...interface{}) *CallBuilder {
+	b.args = append(b.args, args...)
+	return b
+}
+
+// Timeout limits the duration of each attempt of the call.
+func (b *CallBuilder) Timeout(d time.Duration) *CallBuilder {
+	b.timeout = d
+	return b
+}
+
+// Header adds an HTTP header to the request.
+func (b *CallBuilder) Header(key, value string) *CallBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// Retry makes Execute retry the call up to n more times if sending it
+// fails, such as on network errors or non-2xx HTTP responses. Faults and
+// invalid responses are not retried.
+func (b *CallBuilder) Retry(n int) *CallBuilder {
+	b.retry = n
+	return b
+}
+
+// Backoff sets how long to wait before each retry. The default doubles
+// the wait from 100ms up to 5s.
+func (b *CallBuilder) Backoff(backoff BackoffFunc) *CallBuilder {
+	b.backoff = backoff
+	return b
+}
+
+// Execute calls the method on the server at url.
+func (b *CallBuilder) Execute(url string) (Array, error) {
+	return b.ExecuteContext(context.Background(), url)
+}
+
+// ExecuteContext calls the method on the server at url. Cancelling ctx
+// stops the call and any further retries.
+func (b *CallBuilder) ExecuteContext(ctx context.Context, url string) (Array, error) {
+	client := b.client
+	if b.timeout != 0 {
+		c := *client
+		c.Timeout = b.timeout
+		client = &c
+	}
+	rt := httpRoundTrip(client, b.header)
+	if b.retry > 0 {
+		rt = retry(b.retry+1, b.backoff)(rt)
+	}
+	return call(ctx, rt, url, b.name, b.args...)
+}
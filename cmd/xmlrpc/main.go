@@ -0,0 +1,113 @@
+// Command xmlrpc calls an XML-RPC method and prints the result as JSON.
+//
+// Usage:
+//
+//	xmlrpc -url http://example.com/xmlrpc -method blog.getPosts -param '{"postid":42}' -user admin -pass secret
+//
+// Each -param is parsed as JSON and passed as the next positional parameter.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-xmlrpc"
+)
+
+type params []interface{}
+
+func (p *params) String() string { return fmt.Sprintf("%v", *p) }
+
+func (p *params) Set(s string) error {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	*p = append(*p, fromJSON(v))
+	return nil
+}
+
+// fromJSON converts json.Number values to int64 or float64, so they are
+// sent as <int> or <double>.
+func fromJSON(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i := range x {
+			x[i] = fromJSON(x[i])
+		}
+	case map[string]interface{}:
+		for k := range x {
+			x[k] = fromJSON(x[k])
+		}
+	}
+	return v
+}
+
+func main() {
+	var args params
+	flagURL := flag.String("url", "", "XML-RPC endpoint URL")
+	flagMethod := flag.String("method", "", "method name")
+	flagUser := flag.String("user", "", "HTTP basic auth user")
+	flagPass := flag.String("pass", "", "HTTP basic auth password")
+	flagRaw := flag.Bool("raw", false, "print the raw XML response")
+	flag.Var(&args, "param", "JSON encoded parameter (can be repeated)")
+	flag.Parse()
+	if *flagURL == "" || *flagMethod == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var buf bytes.Buffer
+	if err := xmlrpc.Marshal(&buf, *flagMethod, args...); err != nil {
+		log.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", *flagURL, &buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	if *flagUser != "" {
+		req.SetBasicAuth(*flagUser, *flagPass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("%s: %s", resp.Status, body)
+	}
+
+	if *flagRaw {
+		os.Stdout.Write(body)
+		return
+	}
+	_, res, err := xmlrpc.Unmarshal(bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Fatal(err)
+	}
+}
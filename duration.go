@@ -0,0 +1,119 @@
+package xmlrpc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formatISODuration formats d as an ISO 8601 duration such as PT1H30M,
+// with hours as the largest unit.
+func formatISODuration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	var b strings.Builder
+	u := uint64(d)
+	if d < 0 {
+		b.WriteByte('-')
+		u = -u
+	}
+	b.WriteString("PT")
+	if h := u / uint64(time.Hour); h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+		u -= h * uint64(time.Hour)
+	}
+	if m := u / uint64(time.Minute); m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+		u -= m * uint64(time.Minute)
+	}
+	if u > 0 {
+		fmt.Fprintf(&b, "%d", u/uint64(time.Second))
+		if ns := u % uint64(time.Second); ns > 0 {
+			fmt.Fprintf(&b, ".%s", strings.TrimRight(fmt.Sprintf("%09d", ns), "0"))
+		}
+		b.WriteByte('S')
+	}
+	return b.String()
+}
+
+var errDuration = errors.New("invalid ISO 8601 duration")
+
+// ParseISODuration parses an ISO 8601 duration such as PT1H30M or
+// -P1DT12H, as written by Marshal for time.Duration values.
+// Days and weeks are taken as 24 and 168 hours; years and months,
+// which have no fixed length, are not accepted.
+func ParseISODuration(s string) (time.Duration, error) {
+	orig := s
+	neg := strings.HasPrefix(s, "-")
+	if neg || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("%w: %q", errDuration, orig)
+	}
+	s = s[1:]
+	var d time.Duration
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' && !inTime {
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != ',' })
+		if i <= 0 {
+			return 0, fmt.Errorf("%w: %q", errDuration, orig)
+		}
+		var unit time.Duration
+		switch c := s[i]; {
+		case c == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case c == 'H' && inTime:
+			unit = time.Hour
+		case c == 'M' && inTime:
+			unit = time.Minute
+		case c == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("%w: %q", errDuration, orig)
+		}
+		v, err := durationComponent(s[:i], unit)
+		if err != nil || v > math.MaxInt64-d {
+			return 0, fmt.Errorf("%w: %q", errDuration, orig)
+		}
+		d += v
+		s = s[i+1:]
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+// durationComponent returns the number s, which may have a fraction,
+// times unit.
+func durationComponent(s string, unit time.Duration) (time.Duration, error) {
+	intPart, frac, _ := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+	n, err := strconv.ParseUint(intPart, 10, 63)
+	if err != nil || n > uint64(math.MaxInt64/unit) {
+		return 0, errDuration
+	}
+	d := time.Duration(n) * unit
+	for _, c := range frac {
+		if c < '0' || c > '9' {
+			return 0, errDuration
+		}
+		unit /= 10
+		d += time.Duration(c-'0') * unit
+	}
+	if d < 0 {
+		return 0, errDuration
+	}
+	return d, nil
+}
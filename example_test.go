@@ -0,0 +1,38 @@
+package xmlrpc_test
+
+import (
+	"fmt"
+
+	"github.com/mattn/go-xmlrpc"
+)
+
+func ExampleMarshalTo() {
+	b, err := xmlrpc.MarshalTo("add", 1, 2)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+	// Output:
+	// <?xml version="1.0" encoding="UTF-8"?><methodCall><methodName>add</methodName><params><param><value><int>1</int></value></param><param><value><int>2</int></value></param></params></methodCall>
+}
+
+func ExampleUnmarshalBytes() {
+	data := []byte(`<?xml version="1.0"?>
+<methodResponse><params><param><value><int>3</int></value></param></params></methodResponse>`)
+	_, params, err := xmlrpc.UnmarshalBytes(data)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(params[0])
+
+	data = []byte(`<?xml version="1.0"?>
+<methodResponse><fault><value><struct>
+<member><name>faultCode</name><value><int>4</int></value></member>
+<member><name>faultString</name><value><string>Too many parameters.</string></value></member>
+</struct></value></fault></methodResponse>`)
+	_, _, err = xmlrpc.UnmarshalBytes(data)
+	fmt.Println(err)
+	// Output:
+	// 3
+	// 4: Too many parameters.
+}
@@ -0,0 +1,70 @@
+package xmlrpc
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// MarshalFaultXML returns a complete methodResponse document
+// reporting a fault with the given code and message.
+func MarshalFaultXML(code int, message string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Marshal(&buf, "", &Fault{Code: code, Message: message}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FaultCode returns a Fault with just code set, to be used as the target
+// of errors.Is:
+//
+//	if errors.Is(err, xmlrpc.FaultCode(4)) { ... }
+func FaultCode(code int) *Fault {
+	return &Fault{Code: code}
+}
+
+// Is reports whether target is a *Fault with the same Code, so sentinel
+// faults can be checked with errors.Is regardless of their Message.
+func (f *Fault) Is(target error) bool {
+	t, ok := target.(*Fault)
+	return ok && t != nil && t.Code == f.Code
+}
+
+// HTTPStatusCode returns the HTTP status code matching the fault code,
+// following the fault code interoperability spec.
+func (f *Fault) HTTPStatusCode() int {
+	switch f.Code {
+	case -32700, -32701, -32702, -32600, -32602:
+		return http.StatusBadRequest
+	case -32601:
+		return http.StatusNotFound
+	case -32300:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ToHTTPError returns f as an HTTPError.
+func (f *Fault) ToHTTPError() *HTTPError { return &HTTPError{Fault: f} }
+
+// HTTPError is a Fault to be reported with a matching HTTP status code,
+// for servers mixing XML-RPC with plain HTTP error handling.
+type HTTPError struct {
+	Fault *Fault
+}
+
+func (e *HTTPError) Error() string { return e.Fault.Error() }
+
+// Unwrap returns the underlying Fault.
+func (e *HTTPError) Unwrap() error { return e.Fault }
+
+// StatusCode returns the HTTP status code of the fault.
+func (e *HTTPError) StatusCode() int { return e.Fault.HTTPStatusCode() }
+
+// WriteResponse writes the status code and the fault as a methodResponse to w.
+func (e *HTTPError) WriteResponse(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(e.StatusCode())
+	return Marshal(w, "", e.Fault)
+}
@@ -0,0 +1,139 @@
+package xmlrpc
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// fieldMeta describes a struct field encoded as a member.
+type fieldMeta struct {
+	index     []int // for reflect.Value.FieldByIndex, through embedded structs
+	name      string
+	omitEmpty bool
+}
+
+var (
+	structCacheMu sync.RWMutex
+	structCache   = make(map[reflect.Type][]fieldMeta)
+)
+
+// cachedFields returns the encoded fields of the struct type t,
+// computing them on first use.
+func cachedFields(t reflect.Type) []fieldMeta {
+	structCacheMu.RLock()
+	fields, ok := structCache[t]
+	structCacheMu.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = typeFields(t)
+
+	structCacheMu.Lock()
+	structCache[t] = fields
+	structCacheMu.Unlock()
+	return fields
+}
+
+// typeFields returns the encoded fields of the struct type t. The fields
+// of untagged embedded structs are promoted as in encoding/json: of the
+// fields with the same name, the least nested one wins, then a tagged one,
+// and if that is still ambiguous, none of them is encoded.
+func typeFields(t reflect.Type) []fieldMeta {
+	type candidate struct {
+		fieldMeta
+		tagged bool
+	}
+	var all []candidate
+	visiting := make(map[reflect.Type]bool)
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		if visiting[t] {
+			return
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		for n := 0; n < t.NumField(); n++ {
+			f := t.Field(n)
+			if f.PkgPath != "" { // unexported, also when embedded
+				continue
+			}
+			name, omitEmpty := parseTag(f)
+			if name == "-" {
+				continue
+			}
+			idx := append(index[:len(index):len(index)], n)
+			tagName, _, _ := strings.Cut(f.Tag.Get("xmlrpc"), ",")
+			if f.Anonymous && tagName == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft, idx)
+					continue
+				}
+			}
+			all = append(all, candidate{fieldMeta{index: idx, name: name, omitEmpty: omitEmpty}, tagName != ""})
+		}
+	}
+	walk(t, nil)
+
+	var fields []fieldMeta
+	for i, c := range all {
+		dominant, ambiguous := i, false
+		for j, o := range all {
+			if j == i || o.name != c.name {
+				continue
+			}
+			switch d, od := len(all[dominant].index), len(o.index); {
+			case od < d, od == d && o.tagged && !all[dominant].tagged:
+				dominant, ambiguous = j, false
+			case od == d && o.tagged == all[dominant].tagged:
+				ambiguous = true
+			}
+		}
+		if dominant == i && !ambiguous {
+			fields = append(fields, c.fieldMeta)
+		}
+	}
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but reports false
+// instead of panicking when it meets a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// parseTag returns the member name of the struct field f, which can be
+// set with an `xmlrpc:"name"` tag, and whether it has the omitempty option.
+// A name of "-" means the field is skipped.
+func parseTag(f reflect.StructField) (name string, omitEmpty bool) {
+	tag := f.Tag.Get("xmlrpc")
+	if tag == "-" {
+		return "-", false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty
+}
@@ -0,0 +1,67 @@
+package xmlrpc
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+var (
+	// ErrWrongContentType is returned by UnmarshalHTTPRequest if the request
+	// is not text/xml.
+	ErrWrongContentType = errors.New("wrong content type, want text/xml")
+	// ErrBodyTooLarge is returned by UnmarshalHTTPRequest if the request body
+	// exceeds the allowed size.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Handler serves an XML-RPC method call, returning either a result
+// or a fault.
+type Handler interface {
+	ServeXMLRPC(method string, params []interface{}) (interface{}, *Fault)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(method string, params []interface{}) (interface{}, *Fault)
+
+// ServeXMLRPC calls f(method, params).
+func (f HandlerFunc) ServeXMLRPC(method string, params []interface{}) (interface{}, *Fault) {
+	return f(method, params)
+}
+
+// UnmarshalHTTPRequest checks the Content-Type of r and decodes the
+// methodCall in its body, reading at most maxBodySize bytes.
+func UnmarshalHTTPRequest(r *http.Request, maxBodySize int64) (name string, params []interface{}, err error) {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "text/xml" && mt != "application/xml" {
+		return "", nil, ErrWrongContentType
+	}
+	name, params, err = Unmarshal(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return "", nil, ErrBodyTooLarge
+	}
+	if err == nil && name == "" {
+		err = fmt.Errorf("invalid request: %w methodResponse, want methodCall", ErrNameMismatch)
+	}
+	return name, params, err
+}
+
+// MarshalHTTPResponse writes fault, or result if fault is nil,
+// as a methodResponse to w.
+func MarshalHTTPResponse(w http.ResponseWriter, result interface{}, fault *Fault) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var err error
+	if fault != nil {
+		err = Marshal(buf, "", fault)
+	} else {
+		err = Marshal(buf, "", result)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,74 @@
+package xmlrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// RoundTripFunc sends the marshaled call req of method to url and
+// returns the body of the response.
+type RoundTripFunc func(ctx context.Context, url, method string, req io.Reader) (io.ReadCloser, error)
+
+// ClientMiddleware wraps a RoundTripFunc, for example to log, trace or
+// modify calls.
+type ClientMiddleware func(next RoundTripFunc) RoundTripFunc
+
+// Use adds middlewares to c. The first one registered is the outermost,
+// and sees each call first.
+func (c *Client) Use(mw ...ClientMiddleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mw = append(c.mw, mw...)
+}
+
+// roundTrip returns the middleware chain of c around the HTTP transport,
+// and the URL to call.
+func (c *Client) roundTrip() (RoundTripFunc, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rt := httpRoundTrip(c.HttpClient, c.header.Clone())
+	for i := len(c.mw) - 1; i >= 0; i-- {
+		rt = c.mw[i](rt)
+	}
+	return rt, c.url
+}
+
+// httpRoundTrip returns a RoundTripFunc which POSTs the request with client.
+func httpRoundTrip(client *http.Client, header http.Header) RoundTripFunc {
+	return func(ctx context.Context, url, method string, body io.Reader) (io.ReadCloser, error) {
+		req, e := http.NewRequestWithContext(ctx, "POST", url, body)
+		if e != nil {
+			return nil, e
+		}
+		if pr, ok := body.(*pooledBodyReader); ok {
+			req.GetBody = func() (io.ReadCloser, error) { return pr.body.reader(), nil }
+			req.ContentLength = int64(pr.body.buf.Len())
+		}
+		for k, vv := range header {
+			req.Header[k] = vv
+		}
+		req.Header.Set("Content-Type", "text/xml")
+		r, e := client.Do(req)
+		if e != nil {
+			return nil, e
+		}
+		if r.StatusCode/100 != 2 {
+			drainBody{r.Body}.Close()
+			return nil, errors.New(http.StatusText(http.StatusBadRequest))
+		}
+		return drainBody{r.Body}, nil
+	}
+}
+
+// drainBody discards the unread rest of the body on Close, which allows
+// the http transport to reuse the connection.
+type drainBody struct {
+	io.ReadCloser
+}
+
+func (b drainBody) Close() error {
+	io.Copy(io.Discard, b.ReadCloser)
+	return b.ReadCloser.Close()
+}
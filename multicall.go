@@ -0,0 +1,57 @@
+package xmlrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// MethodCall is a single call of a system.multicall batch.
+type MethodCall struct {
+	Name string        `xmlrpc:"methodName"`
+	Args []interface{} `xmlrpc:"params"`
+}
+
+// Multicall sends calls to the server at url in a single system.multicall
+// request. It returns the result or the fault of each call at the same
+// index, or an error if the whole request failed.
+func Multicall(ctx context.Context, url string, calls []MethodCall) ([]interface{}, []error, error) {
+	return multicall(ctx, httpRoundTrip(defaultClient, nil), url, calls)
+}
+
+// Multicall sends calls in a single system.multicall request,
+// see the Multicall function.
+func (c *Client) Multicall(ctx context.Context, calls []MethodCall) ([]interface{}, []error, error) {
+	rt, url := c.roundTrip()
+	return multicall(ctx, rt, url, calls)
+}
+
+func multicall(ctx context.Context, rt RoundTripFunc, url string, calls []MethodCall) ([]interface{}, []error, error) {
+	v, err := call(ctx, rt, url, "system.multicall", calls)
+	if err != nil {
+		return nil, nil, err
+	}
+	var responses Array
+	if len(v) == 1 {
+		responses, _ = v[0].(Array)
+	}
+	if len(responses) != len(calls) {
+		return nil, nil, fmt.Errorf("system.multicall: want %d responses, got %#v", len(calls), v)
+	}
+	results := make([]interface{}, len(calls))
+	errs := make([]error, len(calls))
+	for i, resp := range responses {
+		switch x := resp.(type) {
+		case Array:
+			if len(x) != 1 {
+				errs[i] = fmt.Errorf("%s: want a single result, got %#v", calls[i].Name, x)
+				continue
+			}
+			results[i] = x[0]
+		case Struct:
+			errs[i] = faultFromStruct(x)
+		default:
+			errs[i] = fmt.Errorf("%s: unexpected response %#v", calls[i].Name, x)
+		}
+	}
+	return results, errs, nil
+}
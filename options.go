@@ -0,0 +1,168 @@
+package xmlrpc
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	timeout   time.Duration
+	transport http.RoundTripper
+	tlsConfig *tls.Config
+	insecure  bool
+	certFile  string
+	keyFile   string
+	user      string
+	pass      string
+	basicAuth bool
+	userAgent string
+	retries   int
+	backoff   BackoffFunc
+	http2     bool
+	h2c       bool
+	keepAlive bool
+	maxIdle   int
+	idleTime  time.Duration
+}
+
+// WithTimeout sets the time limit for each call. The default is 10 seconds.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *clientConfig) { c.timeout = d }
+}
+
+// WithTransport sets the RoundTripper used to send requests.
+// The default is http.DefaultTransport.
+func WithTransport(t http.RoundTripper) ClientOption {
+	return func(c *clientConfig) { c.transport = t }
+}
+
+// WithTLSConfig sets the TLS configuration of the transport. It only
+// applies when the transport is an *http.Transport, which is cloned.
+func WithTLSConfig(tc *tls.Config) ClientOption {
+	return func(c *clientConfig) { c.tlsConfig = tc }
+}
+
+// WithInsecureSkipVerify disables verification of the server certificate.
+// Use it only for development and testing.
+func WithInsecureSkipVerify() ClientOption {
+	return func(c *clientConfig) { c.insecure = true }
+}
+
+// WithClientCert presents the key pair in certFile and keyFile to the
+// server for mutual TLS. The files are read at the first handshake.
+func WithClientCert(certFile, keyFile string) ClientOption {
+	return func(c *clientConfig) { c.certFile, c.keyFile = certFile, keyFile }
+}
+
+// WithHTTP2 makes the client use HTTP/2 where possible. Over TLS it is
+// negotiated with the server. If allowH2C is true, http:// endpoints are
+// called with unencrypted HTTP/2 (h2c) instead of HTTP/1.1, which the
+// server must support. https:// endpoints can still fall back to HTTP/1.1.
+func WithHTTP2(allowH2C bool) ClientOption {
+	return func(c *clientConfig) { c.http2, c.h2c = true, allowH2C }
+}
+
+// WithKeepAlive sets how many idle connections are kept open to the
+// server, and for how long, to be reused by later calls.
+func WithKeepAlive(maxIdle int, idleTimeout time.Duration) ClientOption {
+	return func(c *clientConfig) { c.keepAlive, c.maxIdle, c.idleTime = true, maxIdle, idleTimeout }
+}
+
+// WithBasicAuth sends HTTP basic authentication with every request.
+// It is not passed on when the server redirects to another host.
+func WithBasicAuth(user, pass string) ClientOption {
+	return func(c *clientConfig) { c.user, c.pass, c.basicAuth = user, pass, true }
+}
+
+// WithUserAgent sets the User-Agent header of every request.
+func WithUserAgent(ua string) ClientOption {
+	return func(c *clientConfig) { c.userAgent = ua }
+}
+
+// roundTripper builds the transport described by c.
+func (c *clientConfig) roundTripper() http.RoundTripper {
+	rt := c.transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if t, ok := rt.(*http.Transport); ok {
+		if tc := c.tlsClientConfig(); tc != nil || c.http2 || c.keepAlive {
+			t = t.Clone()
+			if tc != nil {
+				t.TLSClientConfig = tc
+			}
+			if c.keepAlive {
+				t.MaxIdleConnsPerHost = c.maxIdle
+				t.IdleConnTimeout = c.idleTime
+			}
+			rt = t
+			if c.http2 {
+				t.ForceAttemptHTTP2 = true
+				t.Protocols = new(http.Protocols)
+				t.Protocols.SetHTTP1(true)
+				t.Protocols.SetHTTP2(true)
+				if c.h2c {
+					// Only a transport without HTTP1 uses h2c, so keep
+					// one for https:// requests which may need HTTP/1.1.
+					h2c := t.Clone()
+					h2c.Protocols = new(http.Protocols)
+					h2c.Protocols.SetUnencryptedHTTP2(true)
+					rt = &h2cTransport{base: t, h2c: h2c}
+				}
+			}
+		}
+	}
+	return rt
+}
+
+// h2cTransport sends http:// requests with h2c, and others with base.
+type h2cTransport struct {
+	base, h2c http.RoundTripper
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// tlsClientConfig returns the TLS configuration described by c, or nil.
+func (c *clientConfig) tlsClientConfig() *tls.Config {
+	if c.tlsConfig == nil && !c.insecure && c.certFile == "" {
+		return nil
+	}
+	tc := c.tlsConfig.Clone()
+	if tc == nil {
+		tc = new(tls.Config)
+	}
+	if c.insecure {
+		tc.InsecureSkipVerify = true
+	}
+	if c.certFile != "" {
+		tc.GetClientCertificate = loadClientCert(c.certFile, c.keyFile)
+	}
+	return tc
+}
+
+// loadClientCert returns a tls.Config.GetClientCertificate function,
+// which loads the key pair once.
+func loadClientCert(certFile, keyFile string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	var (
+		once sync.Once
+		cert tls.Certificate
+		err  error
+	)
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		once.Do(func() { cert, err = tls.LoadX509KeyPair(certFile, keyFile) })
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}
+}
@@ -0,0 +1,64 @@
+package xmlrpc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// maxPooledBuffer keeps exceptionally large buffers out of the pool.
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *bytes.Buffer { return bufPool.Get().(*bytes.Buffer) }
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// pooledBody is a request body marshaled into a pooled buffer.
+// The http.Transport may read and close a request body after Do has
+// returned, so the buffer goes back to the pool only when the caller and
+// every reader (including the ones made by GetBody) released it.
+type pooledBody struct {
+	buf  *bytes.Buffer
+	refs int32
+}
+
+func newPooledBody(name string, args ...interface{}) (*pooledBody, error) {
+	buf := getBuffer()
+	if err := Marshal(buf, name, args...); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return &pooledBody{buf: buf, refs: 1}, nil
+}
+
+// reader returns a new reader of the body, which must be closed.
+func (b *pooledBody) reader() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	return &pooledBodyReader{Reader: bytes.NewReader(b.buf.Bytes()), body: b}
+}
+
+func (b *pooledBody) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		putBuffer(b.buf)
+	}
+}
+
+type pooledBodyReader struct {
+	*bytes.Reader
+	body *pooledBody
+	once sync.Once
+}
+
+func (r *pooledBodyReader) Close() error {
+	r.once.Do(r.body.release)
+	return nil
+}
@@ -0,0 +1,82 @@
+package xmlrpc
+
+import (
+	"encoding/xml"
+	"io"
+	"reflect"
+	"sync"
+)
+
+var (
+	registryMu sync.RWMutex
+	encoders   = make(map[reflect.Type]func(io.Writer, interface{}) error)
+	decoders   = make(map[reflect.Type]func(string) (interface{}, error))
+)
+
+// RegisterEncoder makes Marshal encode values of type t with fn, which must
+// write a complete typed value such as <string>...</string>.
+// This is meant for types defined in other packages. A nil fn removes the
+// encoder of t.
+func RegisterEncoder(t reflect.Type, fn func(io.Writer, interface{}) error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if fn == nil {
+		delete(encoders, t)
+	} else {
+		encoders[t] = fn
+	}
+}
+
+// RegisterDecoder makes every Decoder convert each scalar value which
+// would be decoded as type t (string, int64, float64, bool, time.Time or
+// []byte) by calling fn with the raw text of the element. A nil fn removes
+// the decoder of t.
+//
+// This affects all decoding in the program, including the responses of
+// Call and Client. To convert the values read by a single Decoder, use
+// Decoder.RegisterDecoder instead. Fault members are never converted.
+func RegisterDecoder(t reflect.Type, fn func(string) (interface{}, error)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if fn == nil {
+		delete(decoders, t)
+	} else {
+		decoders[t] = fn
+	}
+}
+
+func lookupEncoder(t reflect.Type) func(io.Writer, interface{}) error {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return encoders[t]
+}
+
+// RegisterDecoder is like the RegisterDecoder function, but only affects
+// d. It takes precedence over the decoders registered for all Decoders,
+// and a nil fn turns off the one registered for t.
+func (d *Decoder) RegisterDecoder(t reflect.Type, fn func(string) (interface{}, error)) {
+	if d.decoders == nil {
+		d.decoders = make(map[reflect.Type]func(string) (interface{}, error))
+	}
+	d.decoders[t] = fn
+}
+
+// decoded returns v, or the result of the decoder registered for its type,
+// called with the raw text s.
+func (d *Decoder) decoded(v interface{}, s string, e error) (xml.Name, interface{}, error) {
+	if e != nil || d.inFault {
+		return xml.Name{}, v, e
+	}
+	t := reflect.TypeOf(v)
+	fn, ok := d.decoders[t]
+	if !ok {
+		registryMu.RLock()
+		fn = decoders[t]
+		registryMu.RUnlock()
+	}
+	if fn == nil {
+		return xml.Name{}, v, nil
+	}
+	v, e = fn(s)
+	return xml.Name{}, v, e
+}
@@ -0,0 +1,70 @@
+package xmlrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// BackoffFunc returns how long to wait before the given retry attempt,
+// starting from 1.
+type BackoffFunc func(attempt int) time.Duration
+
+// ExponentialBackoff returns a BackoffFunc which doubles the wait from
+// base on each attempt, up to max.
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// WithRetry makes up to maxAttempts attempts of a call when sending it
+// fails, such as on network errors or non-2xx HTTP responses. Faults
+// returned by the server are not retried. The context of the call stops
+// the retries early.
+func WithRetry(maxAttempts int, backoff BackoffFunc) ClientOption {
+	return func(c *clientConfig) {
+		c.retries = maxAttempts
+		c.backoff = backoff
+	}
+}
+
+// retry returns a ClientMiddleware which implements WithRetry.
+func retry(maxAttempts int, backoff BackoffFunc) ClientMiddleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(ctx context.Context, url, method string, req io.Reader) (io.ReadCloser, error) {
+			b, e := io.ReadAll(req)
+			if c, ok := req.(io.Closer); ok {
+				c.Close()
+			}
+			if e != nil {
+				return nil, e
+			}
+			for attempt := 1; ; attempt++ {
+				r, e := next(ctx, url, method, bytes.NewReader(b))
+				if e == nil || attempt >= maxAttempts || ctx.Err() != nil {
+					return r, e
+				}
+				var wait time.Duration
+				if backoff != nil {
+					wait = backoff(attempt)
+				}
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return nil, ctx.Err()
+				case <-t.C:
+				}
+			}
+		}
+	}
+}
@@ -1,37 +1,248 @@
 package xmlrpc
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Array []interface{}
 type Struct map[string]interface{}
 
-func next(p *xml.Decoder) (xml.Name, interface{}, error) {
-	se, nextErr := nextStart(p)
-	if nextErr != nil {
-		return xml.Name{}, nil, nextErr
+// defaultDateTimeFormats are the layouts of dateTime.iso8601 values
+// understood out of the box.
+var defaultDateTimeFormats = []string{
+	"20060102T15:04:05",
+	time.RFC3339, // accepts both Z and ±hh:mm
+	"2006-01-02T15:04:05",
+}
+
+var (
+	dateTimeFormatsMu sync.RWMutex
+	// dateTimeFormats are tried in order when parsing a dateTime.iso8601 value.
+	dateTimeFormats = DefaultDateTimeFormats()
+)
+
+// DefaultDateTimeFormats returns the built-in layouts used to parse
+// dateTime.iso8601 values.
+func DefaultDateTimeFormats() []string {
+	return append([]string(nil), defaultDateTimeFormats...)
+}
+
+// RegisterDateTimeFormat adds a layout, in the format of time.Parse, to
+// the ones tried when parsing dateTime.iso8601 values, such as
+// "2006-01-02 15:04:05".
+func RegisterDateTimeFormat(format string) {
+	dateTimeFormatsMu.Lock()
+	defer dateTimeFormatsMu.Unlock()
+	dateTimeFormats = append(dateTimeFormats, format)
+}
+
+// ClearDateTimeFormats removes all layouts used to parse dateTime.iso8601
+// values, including the built-in ones. Use RegisterDateTimeFormat to add
+// the layouts wanted instead.
+func ClearDateTimeFormats() {
+	dateTimeFormatsMu.Lock()
+	defer dateTimeFormatsMu.Unlock()
+	dateTimeFormats = nil
+}
+
+// defaultDateOnlyFormats are tried after dateTimeFormats, as some servers
+// (e.g. WordPress) omit the time component.
+var defaultDateOnlyFormats = []string{"20060102", "2006-01-02"}
+
+// IntType selects the Go type of decoded integers.
+type IntType int
+
+const (
+	// IntType64 decodes integers as int64. This is the default.
+	IntType64 IntType = iota
+	// IntType32 decodes integers as int32.
+	IntType32
+	// IntTypeNative decodes integers as int.
+	IntTypeNative
+)
+
+// Limits guarding against maliciously large messages.
+const (
+	defaultMaxParams        = 100
+	defaultMaxStructMembers = 1000
+	defaultMaxNestingDepth  = 100
+)
+
+// Decoder reads and decodes XML-RPC messages from an input stream.
+type Decoder struct {
+	p                *xml.Decoder
+	tail             *tailReader
+	intern           map[string]string
+	dateOnlyFormats  []string
+	maxParams        int
+	maxStructMembers int
+	maxDepth         int
+	depth            int // of the elements being decoded
+	faultCoerce      bool
+	intType          IntType
+	decoders         map[reflect.Type]func(string) (interface{}, error)
+	inFault          bool // registered decoders are not used for faults
+}
+
+// utf8BOM is the byte order mark some servers put before the document.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// NewDecoder returns a new Decoder that reads from r.
+// A leading UTF-8 byte order mark is skipped.
+func NewDecoder(r io.Reader) *Decoder {
+	br := bufio.NewReader(r)
+	if b, _ := br.Peek(len(utf8BOM)); bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	tr := &tailReader{r: br}
+	return &Decoder{
+		p:                xml.NewDecoder(tr),
+		tail:             tr,
+		maxParams:        defaultMaxParams,
+		maxStructMembers: defaultMaxStructMembers,
+		maxDepth:         defaultMaxNestingDepth,
 	}
+}
+
+// SetStringInterning makes the Decoder return the same string instance for
+// repeated string values and struct member names, which saves memory when
+// decoding large collections of similar structs.
+func (d *Decoder) SetStringInterning(on bool) {
+	if !on {
+		d.intern = nil
+	} else if d.intern == nil {
+		d.intern = make(map[string]string)
+	}
+}
+
+// SetDateOnlyFormats replaces the layouts used to parse dateTime.iso8601
+// values which have no time component. Such values are returned as
+// midnight UTC.
+func (d *Decoder) SetDateOnlyFormats(formats []string) {
+	d.dateOnlyFormats = formats
+}
+
+// SetFaultCoerce makes Decode treat a methodResponse whose only param is a
+// struct with faultCode and faultString members as a fault. Some PHP
+// servers send faults this way instead of using the <fault> element.
+func (d *Decoder) SetFaultCoerce(on bool) {
+	d.faultCoerce = on
+}
+
+// SetMaxParams sets how many params a message may have, 100 by default.
+func (d *Decoder) SetMaxParams(n int) {
+	d.maxParams = n
+}
+
+// SetMaxStructMembers sets how many members a struct may have, 1000 by
+// default.
+func (d *Decoder) SetMaxStructMembers(n int) {
+	d.maxStructMembers = n
+}
+
+// SetMaxNestingDepth sets how deeply elements may be nested in a message,
+// 100 by default. Every element counts, so each level of arrays or structs
+// takes two, for the container and its <value>, and the default allows 48
+// levels of arrays in a response. Deeper messages are rejected with
+// ErrLimitExceeded instead of exhausting the stack.
+func (d *Decoder) SetMaxNestingDepth(n int) {
+	d.maxDepth = n
+}
+
+// SetIntType sets the Go type of decoded <int>, <i4>, etc. values.
+// <i8> values are always decoded as int64.
+func (d *Decoder) SetIntType(t IntType) {
+	d.intType = t
+}
+
+func (d *Decoder) parseInt(s string) (interface{}, error) {
+	switch d.intType {
+	case IntType32:
+		i, e := strconv.ParseInt(s, 10, 32)
+		return int32(i), e
+	case IntTypeNative:
+		return strconv.Atoi(s)
+	default:
+		return strconv.ParseInt(s, 10, 64)
+	}
+}
 
+func (d *Decoder) parseTime(s string) (time.Time, error) {
+	var t time.Time
+	e := fmt.Errorf("cannot parse %q as dateTime.iso8601", s)
+	dateTimeFormatsMu.RLock()
+	formats := dateTimeFormats
+	dateTimeFormatsMu.RUnlock()
+	for _, format := range formats {
+		if t, e = time.Parse(format, s); e == nil {
+			return t, nil
+		}
+	}
+	dateOnlyFormats := d.dateOnlyFormats
+	if dateOnlyFormats == nil {
+		dateOnlyFormats = defaultDateOnlyFormats
+	}
+	for _, format := range dateOnlyFormats {
+		if day, err := time.Parse(format, s); err == nil {
+			return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return t, e
+}
+
+func (d *Decoder) internString(s string) string {
+	if d.intern == nil {
+		return s
+	}
+	if is, ok := d.intern[s]; ok {
+		return is
+	}
+	d.intern[s] = s
+	return s
+}
+
+func (d *Decoder) next() (xml.Name, interface{}, error) {
+	se, e := nextStart(d.p)
+	if e != nil {
+		return xml.Name{}, nil, e
+	}
+	return d.decode(se)
+}
+
+// decode decodes the element started by se, including its end element.
+func (d *Decoder) decode(se xml.StartElement) (xml.Name, interface{}, error) {
+	p := d.p
 	var nv interface{}
+	if d.depth >= d.maxDepth {
+		return xml.Name{}, nil, fmt.Errorf("%w: elements nested deeper than %d", ErrLimitExceeded, d.maxDepth)
+	}
+	d.depth++
+	defer func() { d.depth-- }()
 	switch se.Name.Local {
 	case "string":
 		var s string
 		if e := p.DecodeElement(&s, &se); e != nil {
 			return xml.Name{}, nil, e
 		}
-		return xml.Name{}, s, nil
+		return d.decoded(d.internString(s), s, nil)
 	case "boolean":
 		var s string
 		if e := p.DecodeElement(&s, &se); e != nil {
@@ -47,36 +258,38 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 		default:
 			return xml.Name{}, b, errors.New("invalid boolean value")
 		}
-		return xml.Name{}, b, nil
-	case "int", "i1", "i2", "i4", "i8":
+		return d.decoded(b, s, nil)
+	case "int", "i1", "i2", "i4":
+		var s string
+		if e := p.DecodeElement(&s, &se); e != nil {
+			return xml.Name{}, nil, e
+		}
+		i, e := d.parseInt(strings.TrimSpace(s))
+		return d.decoded(i, s, e)
+	case "i8":
 		var s string
-		var i int
 		if e := p.DecodeElement(&s, &se); e != nil {
 			return xml.Name{}, nil, e
 		}
-		i, e := strconv.Atoi(strings.TrimSpace(s))
-		return xml.Name{}, i, e
+		i, e := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		return d.decoded(i, s, e)
 	case "double":
 		var s string
-		var f float64
 		if e := p.DecodeElement(&s, &se); e != nil {
 			return xml.Name{}, nil, e
 		}
 		f, e := strconv.ParseFloat(strings.TrimSpace(s), 64)
-		return xml.Name{}, f, e
+		if e != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return xml.Name{}, nil, fmt.Errorf("%w: %q", ErrInvalidFloat, s)
+		}
+		return d.decoded(f, s, nil)
 	case "dateTime.iso8601":
 		var s string
 		if e := p.DecodeElement(&s, &se); e != nil {
 			return xml.Name{}, nil, e
 		}
-		t, e := time.Parse("20060102T15:04:05", s)
-		if e != nil {
-			t, e = time.Parse("2006-01-02T15:04:05-07:00", s)
-			if e != nil {
-				t, e = time.Parse("2006-01-02T15:04:05", s)
-			}
-		}
-		return xml.Name{}, t, e
+		t, e := d.parseTime(s)
+		return d.decoded(t, s, e)
 	case "base64":
 		var s string
 		if e := p.DecodeElement(&s, &se); e != nil {
@@ -85,95 +298,128 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 		if b, e := base64.StdEncoding.DecodeString(s); e != nil {
 			return xml.Name{}, nil, e
 		} else {
-			return xml.Name{}, b, nil
+			return d.decoded(b, s, nil)
 		}
-	case "member":
-		nextStart(p)
-		return next(p)
 
-	case "value", "name", "param":
-		nextStart(p)
-		return next(p)
+	case "value":
+		// A value without a type element is a string.
+		var text []byte
+		for {
+			t, e := p.Token()
+			if e != nil {
+				return xml.Name{}, nil, e
+			}
+			switch t := t.(type) {
+			case xml.CharData:
+				text = append(text, t...)
+			case xml.StartElement:
+				name, v, e := d.decode(t)
+				if e != nil {
+					return name, v, e
+				}
+				return name, v, p.Skip()
+			case xml.EndElement:
+				s := string(text)
+				return d.decoded(d.internString(s), s, nil)
+			}
+		}
+	case "param":
+		child, e := nextChild(p)
+		if e != nil || child == nil {
+			return xml.Name{}, "", e
+		}
+		name, v, e := d.decode(*child)
+		if e != nil {
+			return name, v, e
+		}
+		return name, v, p.Skip()
 
 	case "struct":
 		st := Struct{}
-
-		var e error
-		se, e = nextStart(p)
-		for e == nil && se.Name.Local == "member" {
-			// name
-			se, e = nextStart(p)
-			if se.Name.Local != "name" {
-				return xml.Name{}, nil, errors.New("invalid response")
-			}
+		var n int
+		for {
+			child, e := nextChild(p)
 			if e != nil {
-				break
-			}
-			var name string
-			if e = p.DecodeElement(&name, &se); e != nil {
 				return xml.Name{}, nil, e
 			}
-			se, e = nextStart(p)
-			if e != nil {
-				break
+			if child == nil {
+				return xml.Name{}, st, nil
 			}
-
-			// value
-			_, value, e := next(p)
-			if se.Name.Local != "value" {
-				return xml.Name{}, nil, errors.New("invalid response")
+			if child.Name.Local != "member" {
+				if e = p.Skip(); e != nil {
+					return xml.Name{}, nil, e
+				}
+				continue
 			}
-			if e != nil {
-				break
+			if n >= d.maxStructMembers {
+				return xml.Name{}, nil, fmt.Errorf("%w: more than %d struct members", ErrLimitExceeded, d.maxStructMembers)
 			}
-			st[name] = value
-
-			se, e = nextStart(p)
+			n++
+			name, value, e := d.decodeMember()
 			if e != nil {
-				break
+				return xml.Name{}, nil, e
 			}
+			st[name] = value
 		}
-		return xml.Name{}, st, e
 
 	case "array":
 		var ar Array
-		nextStart(p) // data
 		for {
-			nextStart(p) // top of value
-			_, value, e := next(p)
+			data, e := nextChild(p)
 			if e != nil {
-				break
+				return xml.Name{}, nil, e
+			}
+			if data == nil {
+				return xml.Name{}, ar, nil
+			}
+			for {
+				child, e := nextChild(p)
+				if e != nil {
+					return xml.Name{}, nil, e
+				}
+				if child == nil {
+					break
+				}
+				_, value, e := d.decode(*child)
+				if e != nil {
+					return xml.Name{}, nil, e
+				}
+				ar = append(ar, value)
 			}
-			ar = append(ar, value)
 		}
-		return xml.Name{}, ar, nil
 
 	case "nil":
-		return xml.Name{}, nil, nil
+		return xml.Name{}, nil, p.Skip()
 
 	case "params":
 		var ar Array
 		for {
-			_, value, e := next(p)
+			child, e := nextChild(p)
 			if e != nil {
-				break
+				return xml.Name{}, nil, e
+			}
+			if child == nil {
+				return xml.Name{}, ar, nil
+			}
+			if len(ar) >= d.maxParams {
+				return xml.Name{}, nil, fmt.Errorf("%w: more than %d params", ErrLimitExceeded, d.maxParams)
+			}
+			_, value, e := d.decode(*child)
+			if e != nil {
+				return xml.Name{}, nil, e
 			}
 			ar = append(ar, value)
 		}
-		return xml.Name{}, ar, nil
 
 	case "fault":
-		_, value, _ := next(p)
+		d.inFault = true
+		_, value, _ := d.next()
+		d.inFault = false
 		fs, ok := value.(Struct)
 		if !ok {
-			return xml.Name{}, value, fmt.Errorf("fault: wanted Struct, got %#v", value)
+			return xml.Name{}, value, fmt.Errorf("%w: wanted Struct, got %#v", ErrMalformedFault, value)
 		}
-		var f Fault
-		if s, ok := fs["faultCode"].(string); ok {
-			f.Code, _ = strconv.Atoi(s)
-		}
-		f.Message, _ = fs["faultString"].(string)
-		return xml.Name{}, nil, &f
+		return xml.Name{}, nil, faultFromStruct(fs)
 
 	}
 
@@ -182,6 +428,46 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	}
 	return se.Name, nv, nil
 }
+
+// decodeMember decodes the <name> and <value> children of a <member>,
+// accepting them in either order.
+func (d *Decoder) decodeMember() (string, interface{}, error) {
+	var (
+		name              string
+		value             interface{}
+		hasName, hasValue bool
+	)
+	for {
+		child, e := nextChild(d.p)
+		if e != nil {
+			return "", nil, e
+		}
+		if child == nil {
+			break
+		}
+		switch child.Name.Local {
+		case "name":
+			if e = d.p.DecodeElement(&name, child); e != nil {
+				return "", nil, e
+			}
+			hasName = true
+		case "value":
+			if _, value, e = d.decode(*child); e != nil {
+				return "", nil, e
+			}
+			hasValue = true
+		default:
+			if e = d.p.Skip(); e != nil {
+				return "", nil, e
+			}
+		}
+	}
+	if !hasName || !hasValue {
+		return "", nil, fmt.Errorf("invalid response: %w: member needs a name and a value", ErrNotStartElement)
+	}
+	return d.internString(name), value, nil
+}
+
 func nextStart(p *xml.Decoder) (xml.StartElement, error) {
 	for {
 		t, e := p.Token()
@@ -195,27 +481,188 @@ func nextStart(p *xml.Decoder) (xml.StartElement, error) {
 	}
 }
 
-var UnsupportedType = errors.New("unsupported type")
+// nextChild returns the next child element of the current element,
+// or nil if the current element ends first.
+func nextChild(p *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		t, e := p.Token()
+		if e != nil {
+			return nil, e
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return &t, nil
+		case xml.EndElement:
+			return nil, nil
+		}
+	}
+}
+
+var (
+	// ErrUnsupportedType is returned when marshaling a value which has no
+	// XML-RPC representation, such as a channel or a function.
+	ErrUnsupportedType = errors.New("unsupported type")
+	// ErrNameMismatch is returned when a message has an element other than
+	// the one the protocol requires at that place.
+	ErrNameMismatch = errors.New("unexpected element")
+	// ErrNotStartElement is returned when a required element is missing.
+	ErrNotStartElement = errors.New("missing element")
+	// ErrMalformedFault is returned for a <fault> whose value is not a struct.
+	ErrMalformedFault = errors.New("malformed fault")
+	// ErrInvalidFloat is returned for a NaN or infinite double, which
+	// XML-RPC cannot represent, and for a <double> which is not a number.
+	ErrInvalidFloat = errors.New("invalid double")
+	// ErrLimitExceeded is returned when a message being decoded exceeds
+	// one of the limits of the Decoder.
+	ErrLimitExceeded = errors.New("decoder limit exceeded")
+)
+
+// UnsupportedType is the former name of ErrUnsupportedType.
+//
+// Deprecated: Use ErrUnsupportedType.
+var UnsupportedType = ErrUnsupportedType
+
+// escapeText writes s to w with XML special characters escaped.
+// Strings of plain printable ASCII are written as is, without copying.
+func escapeText(w io.Writer, s string) error {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < 0x20 || c > 0x7e, c == '"', c == '&', c == '\'', c == '<', c == '>':
+			return xml.EscapeText(w, []byte(s))
+		}
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+type nilValue struct{}
+
+// Nil is encoded as <nil/>, like a nil interface or pointer.
+// <nil/> values are decoded as nil.
+var Nil = nilValue{}
+
+// UseI8ForInt64 makes Marshal encode all int64 and uint64 values as <i8>.
+// Otherwise only integers outside of the <int> (32 bit) range use <i8>.
+var UseI8ForInt64 bool
+
+// intTag returns the element name for the integer r.
+func intTag(r reflect.Value) (string, error) {
+	switch r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := r.Int(); i >= math.MinInt32 && i <= math.MaxInt32 &&
+			!(UseI8ForInt64 && r.Kind() == reflect.Int64) {
+			return "int", nil
+		}
+	default:
+		u := r.Uint()
+		if u > math.MaxInt64 {
+			return "", fmt.Errorf("%d overflows i8", u)
+		}
+		if u <= math.MaxInt32 && !(UseI8ForInt64 && r.Kind() == reflect.Uint64) {
+			return "int", nil
+		}
+	}
+	return "i8", nil
+}
+
+// Marshaler is implemented by types which control their own XML-RPC
+// encoding. The value returned by MarshalXMLRPC is encoded in place of
+// the receiver.
+type Marshaler interface {
+	MarshalXMLRPC() (interface{}, error)
+}
+
+// maxUnwrapDepth bounds the unwrapping of nested reflect.Values.
+const maxUnwrapDepth = 32
 
-func writeXML(w io.Writer, v interface{}, typ bool) error {
-	if v == nil {
+func (enc *Encoder) writeXML(v interface{}, typ bool) error {
+	w := enc.w
+	// The reflect.Interface case passes reflect.Values, which may in turn
+	// wrap reflect.Values: unwrap them to the concrete value.
+	for depth := 0; ; depth++ {
+		r, ok := v.(reflect.Value)
+		if !ok {
+			break
+		}
+		if depth == maxUnwrapDepth {
+			return errors.New("value is wrapped too deeply")
+		}
+		if r.Kind() == reflect.Interface {
+			r = r.Elem()
+		}
+		if !r.IsValid() {
+			v = nil
+			break
+		}
+		if !r.CanInterface() {
+			return ErrUnsupportedType
+		}
+		v = r.Interface()
+	}
+	if v == nil || v == Nil {
 		_, err := io.WriteString(w, "<nil/>")
 		return err
 	}
+	if r := reflect.ValueOf(v); r.Kind() == reflect.Ptr && r.IsNil() {
+		_, err := io.WriteString(w, "<nil/>")
+		return err
+	}
+	if fn := lookupEncoder(reflect.TypeOf(v)); fn != nil {
+		return fn(w, v)
+	}
 	r := reflect.ValueOf(v)
 	t := r.Type()
 	k := t.Kind()
 
-	if b, ok := v.([]byte); ok {
+	switch x := v.(type) {
+	case Marshaler:
+		mv, err := x.MarshalXMLRPC()
+		if err != nil {
+			return err
+		}
+		if reflect.TypeOf(mv) == t {
+			return fmt.Errorf("%s.MarshalXMLRPC returned its own type", t)
+		}
+		return enc.writeXML(mv, typ)
+	case net.IP:
+		if x == nil {
+			_, err := io.WriteString(w, "<nil/>")
+			return err
+		}
+		return enc.writeXML(x.String(), typ)
+	case url.URL:
+		return enc.writeXML(x.String(), typ)
+	case *url.URL:
+		return enc.writeXML(x.String(), typ)
+	case time.Time:
+		// RFC 3339 writes Z for UTC, as some servers reject +00:00.
+		_, err := fmt.Fprintf(w, "<dateTime.iso8601>%s</dateTime.iso8601>", x.Format(time.RFC3339))
+		return err
+	case time.Duration:
+		return enc.writeXML(formatISODuration(x), typ)
+	case encoding.TextMarshaler:
+		b, err := x.MarshalText()
+		if err != nil {
+			return err
+		}
+		return enc.writeXML(string(b), typ)
+	}
+
+	if k == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		b := r.Bytes()
 		io.WriteString(w, "<base64>")
-		_, err := base64.NewEncoder(base64.StdEncoding, w).Write(b)
-		io.WriteString(w, "</base64>")
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		enc.Write(b)
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "</base64>")
 		return err
 	}
 
 	switch k {
 	case reflect.Invalid:
-		return UnsupportedType
+		return ErrUnsupportedType
 	case reflect.Bool:
 		_, err := fmt.Fprintf(w, "<boolean>%v</boolean>", v)
 		return err
@@ -224,14 +671,21 @@ func writeXML(w io.Writer, v interface{}, typ bool) error {
 		reflect.Uint,
 		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		if typ {
-			_, err := fmt.Fprintf(w, "<int>%v</int>", v)
+			tag, err := intTag(r)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "<%s>%v</%s>", tag, v, tag)
 			return err
 		}
 		_, err := fmt.Fprintf(w, "%v", v)
 		return err
 	case reflect.Uintptr:
-		return UnsupportedType
+		return ErrUnsupportedType
 	case reflect.Float32, reflect.Float64:
+		if f := r.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%w: %v", ErrInvalidFloat, f)
+		}
 		if typ {
 			_, err := fmt.Fprintf(w, "<double>%v</double>", v)
 			return err
@@ -239,12 +693,12 @@ func writeXML(w io.Writer, v interface{}, typ bool) error {
 		_, err := fmt.Fprintf(w, "%v", v)
 		return err
 	case reflect.Complex64, reflect.Complex128:
-		return UnsupportedType
-	case reflect.Array:
+		return ErrUnsupportedType
+	case reflect.Array, reflect.Slice:
 		io.WriteString(w, "<array><data>")
 		for n := 0; n < r.Len(); n++ {
 			io.WriteString(w, "<value>")
-			err := writeXML(w, r.Index(n).Interface(), typ)
+			err := enc.writeXML(r.Index(n).Interface(), typ)
 			io.WriteString(w, "</value>")
 			if err != nil {
 				return err
@@ -253,20 +707,27 @@ func writeXML(w io.Writer, v interface{}, typ bool) error {
 		_, err := io.WriteString(w, "</data></array>")
 		return err
 	case reflect.Chan:
-		return UnsupportedType
+		return ErrUnsupportedType
 	case reflect.Func:
-		return UnsupportedType
+		return ErrUnsupportedType
 	case reflect.Interface:
-		return writeXML(w, r.Elem(), typ)
+		return enc.writeXML(r.Elem(), typ)
 	case reflect.Map:
+		if r.Type().Key().Kind() != reflect.String {
+			return ErrUnsupportedType
+		}
 		io.WriteString(w, "<struct>")
-		for _, key := range r.MapKeys() {
+		keys := r.MapKeys()
+		if enc.sortKeys {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+		for _, key := range keys {
 			io.WriteString(w, "<member><name>")
-			if err := xml.EscapeText(w, []byte(key.Interface().(string))); err != nil {
+			if err := escapeText(w, key.String()); err != nil {
 				return err
 			}
 			io.WriteString(w, "</name><value>")
-			if err := writeXML(w, r.MapIndex(key).Interface(), typ); err != nil {
+			if err := enc.writeXML(r.MapIndex(key).Interface(), typ); err != nil {
 				return err
 			}
 			if _, err := io.WriteString(w, "</value></member>"); err != nil {
@@ -276,23 +737,29 @@ func writeXML(w io.Writer, v interface{}, typ bool) error {
 		_, err := io.WriteString(w, "</struct>")
 		return err
 	case reflect.Ptr:
-		return UnsupportedType
-	case reflect.Slice:
-		return UnsupportedType
+		return enc.writeXML(r.Elem(), typ)
 	case reflect.String:
 		if typ {
 			io.WriteString(w, "<string>")
 		}
-		err := xml.EscapeText(w, []byte(v.(string)))
+		err := escapeText(w, r.String())
 		if typ {
 			io.WriteString(w, "</string>")
 		}
 		return err
 	case reflect.Struct:
 		io.WriteString(w, "<struct>")
-		for n := 0; n < r.NumField(); n++ {
-			fmt.Fprintf(w, "<member><name>%s</name><value>", t.Field(n).Name)
-			if err := writeXML(w, r.FieldByIndex([]int{n}).Interface(), true); err != nil {
+		for _, f := range cachedFields(t) {
+			fv, ok := fieldByIndex(r, f.index)
+			if !ok || f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			io.WriteString(w, "<member><name>")
+			if err := escapeText(w, f.name); err != nil {
+				return err
+			}
+			io.WriteString(w, "</name><value>")
+			if err := enc.writeXML(fv.Interface(), true); err != nil {
 				return err
 			}
 			io.WriteString(w, "</value></member>")
@@ -300,7 +767,7 @@ func writeXML(w io.Writer, v interface{}, typ bool) error {
 		_, err := io.WriteString(w, "</struct>")
 		return err
 	case reflect.UnsafePointer:
-		return writeXML(w, r.Elem(), typ)
+		return ErrUnsupportedType
 	}
 	return nil
 }
@@ -309,25 +776,209 @@ func writeXML(w io.Writer, v interface{}, typ bool) error {
 type Client struct {
 	HttpClient *http.Client
 	url        string
+
+	mu     sync.Mutex
+	header http.Header
+	mw     []ClientMiddleware
+}
+
+// AddPermanentHeader adds an HTTP header sent with every call of c,
+// such as an API key.
+func (c *Client) AddPermanentHeader(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.header == nil {
+		c.header = make(http.Header)
+	}
+	c.header.Add(key, value)
+}
+
+// RemovePermanentHeader removes the header added by AddPermanentHeader.
+func (c *Client) RemovePermanentHeader(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header.Del(key)
 }
 
 // NewClient create new Client
-func NewClient(url string) *Client {
-	return &Client{
-		HttpClient: &http.Client{Transport: http.DefaultTransport, Timeout: 10 * time.Second},
-		url:        url,
+func NewClient(url string, opts ...ClientOption) *Client {
+	cfg := clientConfig{timeout: 10 * time.Second}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	c := &Client{
+		HttpClient: &http.Client{
+			Transport:     cfg.roundTripper(),
+			Timeout:       cfg.timeout,
+			CheckRedirect: checkRedirect,
+		},
+		url: url,
+	}
+	if cfg.basicAuth {
+		// Set on the request, net/http drops it on redirects to other hosts.
+		auth := base64.StdEncoding.EncodeToString([]byte(cfg.user + ":" + cfg.pass))
+		c.AddPermanentHeader("Authorization", "Basic "+auth)
+	}
+	if cfg.userAgent != "" {
+		c.AddPermanentHeader("User-Agent", cfg.userAgent)
+	}
+	if cfg.retries > 1 {
+		c.Use(retry(cfg.retries, cfg.backoff))
+	}
+	return c
+}
+
+// SetBaseURL sets the endpoint which Call sends requests to.
+func (c *Client) SetBaseURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q: not an absolute URL", rawURL)
+	}
+	c.mu.Lock()
+	c.url = u.String()
+	c.mu.Unlock()
+	return nil
+}
+
+// defaultClient is used by the package level Call.
+var defaultClient = &http.Client{CheckRedirect: checkRedirect}
+
+const maxRedirects = 5
+
+// checkRedirect keeps redirected calls as POST with the original body,
+// where net/http would switch to GET (on 301, 302 and 303).
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	orig := via[0]
+	if req.Method == orig.Method {
+		return nil
 	}
+	if orig.GetBody == nil {
+		return fmt.Errorf("cannot resend %s request body to %s", orig.Method, req.URL)
+	}
+	body, err := orig.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Method = orig.Method
+	req.Body, req.GetBody = body, orig.GetBody
+	req.ContentLength = orig.ContentLength
+	req.Header.Set("Content-Type", orig.Header.Get("Content-Type"))
+	return nil
+}
+
+// xmlDeclaration is written at the start of every encoded message.
+const xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>`
+
+// Encoder writes XML-RPC messages to an output stream.
+type Encoder struct {
+	w        io.Writer
+	omitDecl bool
+	sortKeys bool
+	indent   string
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// OmitXMLDeclaration makes Encode leave out the leading <?xml ...?>
+// declaration, e.g. when the message is embedded in another document.
+func (enc *Encoder) OmitXMLDeclaration(omit bool) {
+	enc.omitDecl = omit
+}
+
+// SetSortStructKeys makes the Encoder write map members sorted by key,
+// so equal maps always produce the same output. By default members are
+// written in map iteration order.
+func (enc *Encoder) SetSortStructKeys(sort bool) {
+	enc.sortKeys = sort
+}
+
+// SetIndent makes the Encoder write each element on its own line,
+// indented by indent per level of nesting. Elements holding only text are
+// kept on one line, so no whitespace is added to values. An empty indent,
+// the default, writes no whitespace at all.
+func (enc *Encoder) SetIndent(indent string) {
+	enc.indent = indent
+}
+
+// MarshalOptions control the layout of marshaled documents.
+type MarshalOptions struct {
+	// Compact leaves out all whitespace between elements, overriding Indent.
+	Compact bool
+	// Indent is written once per level of nesting in front of each element
+	// if not empty. See Encoder.SetIndent.
+	Indent string
 }
 
+// Marshal writes a methodCall of name with args to w,
+// or a methodResponse if name is empty.
 func Marshal(w io.Writer, name string, args ...interface{}) error {
-	io.WriteString(w, `<?xml version="1.0"?>`)
+	return MarshalWithOptions(w, name, MarshalOptions{}, args...)
+}
+
+// MarshalWithOptions is like Marshal, with the layout set by opts.
+func MarshalWithOptions(w io.Writer, name string, opts MarshalOptions, args ...interface{}) error {
+	enc := NewEncoder(w)
+	if !opts.Compact {
+		enc.SetIndent(opts.Indent)
+	}
+	return enc.Encode(name, args...)
+}
+
+// MarshalTo is like Marshal, but returns the document as a byte slice.
+func MarshalTo(name string, args ...interface{}) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := Marshal(buf, name, args...); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// Encode writes a methodCall of name with args,
+// or a methodResponse if name is empty.
+// A response with a single *Fault arg is written as a fault.
+func (enc *Encoder) Encode(name string, args ...interface{}) error {
+	if enc.indent == "" {
+		return enc.encode(name, args...)
+	}
+	w := enc.w
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc.w = buf
+	err := enc.encode(name, args...)
+	enc.w = w
+	if err != nil {
+		return err
+	}
+	return indentXML(w, buf.Bytes(), enc.indent)
+}
+
+func (enc *Encoder) encode(name string, args ...interface{}) error {
+	w := enc.w
+	if !enc.omitDecl {
+		io.WriteString(w, xmlDeclaration)
+	}
+	if name == "" && len(args) == 1 {
+		if f, ok := args[0].(*Fault); ok && f != nil {
+			return writeFault(w, f)
+		}
+	}
 	var end string
 	if name == "" {
 		io.WriteString(w, "<methodResponse>")
 		end = "</methodResponse>"
 	} else {
 		io.WriteString(w, "<methodCall><methodName>")
-		if err := xml.EscapeText(w, []byte(name)); err != nil {
+		if err := escapeText(w, name); err != nil {
 			return err
 		}
 		io.WriteString(w, "</methodName>")
@@ -337,7 +988,7 @@ func Marshal(w io.Writer, name string, args ...interface{}) error {
 	io.WriteString(w, "<params>")
 	for _, arg := range args {
 		io.WriteString(w, "<param><value>")
-		if err := writeXML(w, arg, true); err != nil {
+		if err := enc.writeXML(arg, true); err != nil {
 			return err
 		}
 		io.WriteString(w, "</value></param>")
@@ -347,55 +998,145 @@ func Marshal(w io.Writer, name string, args ...interface{}) error {
 	return err
 }
 
-func makeRequest(name string, args ...interface{}) *bytes.Buffer {
-	var buf bytes.Buffer
-	if err := Marshal(&buf, name, args...); err != nil {
-		panic(err)
+// indentXML writes the compact document b to w with every element on its
+// own line, except for the end of elements holding only text.
+// It relies on b being written by an Encoder, with no '<' or '>' in text.
+func indentXML(w io.Writer, b []byte, indent string) error {
+	out := getBuffer()
+	defer putBuffer(out)
+	newline := func(depth int) {
+		out.WriteByte('\n')
+		for i := 0; i < depth; i++ {
+			out.WriteString(indent)
+		}
+	}
+	var depth int
+	leaf := false // no element since the last start element
+	for i := 0; i < len(b); {
+		if b[i] != '<' {
+			j := bytes.IndexByte(b[i:], '<')
+			if j < 0 {
+				j = len(b) - i
+			}
+			out.Write(b[i : i+j])
+			i += j
+			continue
+		}
+		j := bytes.IndexByte(b[i:], '>')
+		if j < 0 {
+			return errors.New("unterminated element")
+		}
+		tag := b[i : i+j+1]
+		first := i == 0
+		i += j + 1
+		switch {
+		case tag[1] == '/':
+			depth--
+			if !leaf {
+				newline(depth)
+			}
+			leaf = false
+		case tag[1] == '?' || tag[len(tag)-2] == '/':
+			if !first {
+				newline(depth)
+			}
+			leaf = false
+		default:
+			if !first {
+				newline(depth)
+			}
+			depth++
+			leaf = true
+		}
+		out.Write(tag)
 	}
-	return &buf
+	_, err := w.Write(out.Bytes())
+	return err
 }
-func call(client *http.Client, url, name string, args ...interface{}) (v Array, e error) {
-	r, e := http.DefaultClient.Post(url, "text/xml", makeRequest(name, args...))
+
+func call(ctx context.Context, rt RoundTripFunc, url, name string, args ...interface{}) (v Array, e error) {
+	body, e := newPooledBody(name, args...)
 	if e != nil {
 		return nil, e
 	}
-
-	// Since we do not always read the entire body, discard the rest, which
-	// allows the http transport to reuse the connection.
-	defer io.Copy(ioutil.Discard, r.Body)
-	defer r.Body.Close()
-
-	if r.StatusCode/100 != 2 {
-		return nil, errors.New(http.StatusText(http.StatusBadRequest))
+	defer body.release()
+	r, e := rt(ctx, url, name, body.reader())
+	if e != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, e
 	}
+	defer r.Close()
 
-	_, v, e = Unmarshal(r.Body)
+	_, v, e = Unmarshal(r)
+	if e != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	return v, e
 }
 
 func Unmarshal(r io.Reader) (string, Array, error) {
+	return NewDecoder(r).Decode()
+}
+
+// UnmarshalBytes is like Unmarshal, but decodes data.
+func UnmarshalBytes(data []byte) (string, Array, error) {
+	return Unmarshal(bytes.NewReader(data))
+}
+
+// Decode reads the next methodCall or methodResponse from its input.
+// The returned name is empty for a methodResponse.
+func (d *Decoder) Decode() (string, Array, error) {
+	name, v, e := d.decodeMessage()
+	var se *xml.SyntaxError
+	if errors.As(e, &se) {
+		e = &ParseError{
+			Method:  name,
+			Offset:  d.p.InputOffset(),
+			Line:    se.Line,
+			Context: d.tail.String(),
+			Err:     e,
+		}
+	}
+	return name, v, e
+}
+
+func (d *Decoder) decodeMessage() (string, Array, error) {
 	var name string
-	p := xml.NewDecoder(r)
+	p := d.p
 	se, e := nextStart(p) // methodResponse
 	if e != nil {
 		return name, nil, e
 	}
 	if se.Name.Local != "methodResponse" {
 		if se.Name.Local != "methodCall" {
-			return name, nil, errors.New("invalid response: missing methodResponse")
+			return name, nil, fmt.Errorf("invalid response: %w %s, want methodResponse", ErrNameMismatch, se.Name.Local)
 		}
 		if se, e = nextStart(p); e != nil {
 			return name, nil, e
 		}
 		if se.Name.Local != "methodName" {
-			return name, nil, errors.New("invalid response: missing methodName")
+			return name, nil, fmt.Errorf("invalid response: %w %s, want methodName", ErrNameMismatch, se.Name.Local)
 		}
 		if e = p.DecodeElement(&name, &se); e != nil {
 			return name, nil, e
 		}
 	}
-	_, v, e := next(p)
+	if se, e = nextStart(p); e != nil {
+		return name, nil, e
+	}
+	_, v, e := d.decode(se)
+	if se.Name.Local == "value" && e == nil {
+		// Some servers leave out <params><param> around a single result.
+		v = Array{v}
+	}
 	if a, ok := v.(Array); ok {
+		if e == nil && d.faultCoerce && name == "" && len(a) == 1 {
+			if fs, ok := a[0].(Struct); ok && isFaultStruct(fs) {
+				return name, nil, faultFromStruct(fs)
+			}
+		}
 		return name, a, e
 	} else if e == nil {
 		e = fmt.Errorf("wanted Array, got %#v", v)
@@ -403,6 +1144,63 @@ func Unmarshal(r io.Reader) (string, Array, error) {
 	return name, nil, e
 }
 
+// ParseError reports malformed XML in a message, with the input preceding
+// the error to help debugging misbehaving servers.
+type ParseError struct {
+	Method  string // name of the method call, if already known
+	Offset  int64  // input offset of the error
+	Line    int
+	Context string // up to 100 bytes of input preceding the error
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	method := e.Method
+	if method == "" {
+		method = "methodResponse"
+	}
+	return fmt.Sprintf("%s: offset %d: %v, after %q", method, e.Offset, e.Err, e.Context)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// tailReader remembers the last bytes read. As it is an io.ByteReader,
+// xml.Decoder reads it byte by byte, so these precede the decoder's offset.
+type tailReader struct {
+	r    *bufio.Reader
+	tail [100]byte
+	n    int
+}
+
+func (t *tailReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.tail[t.n%len(t.tail)] = b
+		t.n++
+	}
+	return b, err
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := t.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
+
+// String returns the remembered bytes in input order.
+func (t *tailReader) String() string {
+	if t.n <= len(t.tail) {
+		return string(t.tail[:t.n])
+	}
+	i := t.n % len(t.tail)
+	return string(t.tail[i:]) + string(t.tail[:i])
+}
+
 type Fault struct {
 	Code    int
 	Message string
@@ -410,12 +1208,111 @@ type Fault struct {
 
 func (f *Fault) Error() string { return fmt.Sprintf("%d: %s", f.Code, f.Message) }
 
+func writeFault(w io.Writer, f *Fault) error {
+	fmt.Fprintf(w, "<methodResponse><fault><value><struct>"+
+		"<member><name>faultCode</name><value><int>%d</int></value></member>"+
+		"<member><name>faultString</name><value><string>", f.Code)
+	if err := escapeText(w, f.Message); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "</string></value></member></struct></value></fault></methodResponse>")
+	return err
+}
+
+// faultFromStruct returns the fault described by fs. A missing faultCode
+// defaults to -1, and a missing faultString to "unknown fault".
+func faultFromStruct(fs Struct) *Fault {
+	f := Fault{Code: -1, Message: "unknown fault"}
+	code, _ := faultMember(fs, "faultCode")
+	switch code := code.(type) {
+	case int64:
+		f.Code = int(code)
+	case int32:
+		f.Code = int(code)
+	case int:
+		f.Code = code
+	case float64:
+		f.Code = int(code)
+	case string:
+		if i, e := strconv.Atoi(strings.TrimSpace(code)); e == nil {
+			f.Code = i
+		}
+	}
+	if msg, ok := faultMember(fs, "faultString"); ok {
+		if s, ok := msg.(string); ok {
+			f.Message = s
+		} else if msg != nil {
+			f.Message = fmt.Sprint(msg)
+		}
+	}
+	return &f
+}
+
+// faultMember looks up the member key of fs, ignoring case if there is no
+// exact match, as some servers send FaultCode or faultcode.
+func faultMember(fs Struct, key string) (interface{}, bool) {
+	if v, ok := fs[key]; ok {
+		return v, true
+	}
+	for k, v := range fs {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func isFaultStruct(fs Struct) bool {
+	_, hasCode := faultMember(fs, "faultCode")
+	_, hasString := faultMember(fs, "faultString")
+	return hasCode && hasString
+}
+
 // Call call remote procedures function name with args
 func (c *Client) Call(name string, args ...interface{}) (v Array, e error) {
-	return call(c.HttpClient, c.url, name, args...)
+	return c.CallContext(context.Background(), name, args...)
+}
+
+// CallContext is like Call, but the request is bound to ctx.
+// It returns ctx.Err() if ctx is done before the call completes.
+func (c *Client) CallContext(ctx context.Context, name string, args ...interface{}) (v Array, e error) {
+	rt, url := c.roundTrip()
+	return call(ctx, rt, url, name, args...)
+}
+
+// AsyncCall represents an active call started with Client.Go.
+type AsyncCall struct {
+	Method string
+	Args   []interface{}
+	Value  Array // the result, when Error is nil
+	Error  error // a *Fault if the server returned a fault
+	Done   chan *AsyncCall
+}
+
+// Go calls the method name with args asynchronously. The returned
+// AsyncCall is sent on done when the call completes. If done is nil,
+// a new channel is allocated; otherwise it must be buffered.
+func (c *Client) Go(name string, args []interface{}, done chan *AsyncCall) *AsyncCall {
+	if done == nil {
+		done = make(chan *AsyncCall, 10)
+	} else if cap(done) == 0 {
+		panic("xmlrpc: done channel is unbuffered")
+	}
+	ac := &AsyncCall{Method: name, Args: args, Done: done}
+	go func() {
+		ac.Value, ac.Error = c.Call(name, args...)
+		ac.Done <- ac
+	}()
+	return ac
 }
 
 // Call call remote procedures function name with args
 func Call(url, name string, args ...interface{}) (v Array, e error) {
-	return call(http.DefaultClient, url, name, args...)
+	return CallContext(context.Background(), url, name, args...)
+}
+
+// CallContext is like Call, but the request is bound to ctx.
+// It returns ctx.Err() if ctx is done before the call completes.
+func CallContext(ctx context.Context, url, name string, args ...interface{}) (v Array, e error) {
+	return call(ctx, httpRoundTrip(defaultClient, nil), url, name, args...)
 }
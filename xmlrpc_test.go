@@ -1,13 +1,35 @@
 package xmlrpc
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func createServer(path, name string, f func(args ...interface{}) (interface{}, error)) http.HandlerFunc {
@@ -16,7 +38,8 @@ func createServer(path, name string, f func(args ...interface{}) (interface{}, e
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-		p := xml.NewDecoder(r.Body)
+		d := NewDecoder(r.Body)
+		p := d.p
 		se, _ := nextStart(p) // methodResponse
 		if se.Name.Local != "methodCall" {
 			http.Error(w, "missing methodCall", http.StatusBadRequest)
@@ -56,7 +79,7 @@ func createServer(path, name string, f func(args ...interface{}) (interface{}, e
 				http.Error(w, "missing value", http.StatusBadRequest)
 				return
 			}
-			_, v, err := next(p)
+			_, v, err := d.next()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -82,22 +105,34 @@ func createServer(path, name string, f func(args ...interface{}) (interface{}, e
 	}
 }
 
+// echoServer returns a handler at /api whose Echo method returns its
+// first argument.
+func echoServer(tb testing.TB) http.HandlerFunc {
+	return createServer("/api", "Echo", func(args ...interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			tb.Error("Echo called without arguments")
+			return nil, errors.New("bad number of arguments")
+		}
+		return args[0], nil
+	})
+}
+
 func TestAddInt(t *testing.T) {
 	ts := httptest.NewServer(createServer("/api", "AddInt", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 2 {
 			return nil, errors.New("bad number of arguments")
 		}
 		switch args[0].(type) {
-		case int:
+		case int64:
 		default:
-			return nil, errors.New("args[0] should be int")
+			return nil, errors.New("args[0] should be int64")
 		}
 		switch args[1].(type) {
-		case int:
+		case int64:
 		default:
-			return nil, errors.New("args[1] should be int")
+			return nil, errors.New("args[1] should be int64")
 		}
-		return args[0].(int) + args[1].(int), nil
+		return args[0].(int64) + args[1].(int64), nil
 	}))
 	defer ts.Close()
 
@@ -106,15 +141,423 @@ func TestAddInt(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	i, ok := v[0].(int)
+	i, ok := v[0].(int64)
 	if !ok {
-		t.Fatalf("want int but got %#v", v)
+		t.Fatalf("want int64 but got %#v", v)
 	}
 	if i != 3 {
 		t.Fatalf("want %v but got %#v", 3, v)
 	}
 }
 
+func TestSetBaseURL(t *testing.T) {
+	ts := httptest.NewServer(echoServer(t))
+	defer ts.Close()
+
+	client := NewClient("http://invalid.example.com")
+	if err := client.SetBaseURL("/api"); err == nil {
+		t.Fatal("want error for relative URL")
+	}
+	if err := client.SetBaseURL(ts.URL + "/api"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b"} {
+		v, err := client.Call("Echo", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[0] != s {
+			t.Fatalf("want %q but got %#v", s, v)
+		}
+	}
+}
+
+func TestSetBaseURLConcurrent(t *testing.T) {
+	ts := httptest.NewServer(echoServer(t))
+	defer ts.Close()
+
+	client := NewClient(ts.URL + "/api")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := client.Call("Echo", j); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := client.SetBaseURL(ts.URL + "/api"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestPermanentHeader(t *testing.T) {
+	echo := echoServer(t)
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("X-Api-Key"))
+		echo(w, r)
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL + "/api")
+	client.AddPermanentHeader("X-Api-Key", "abc123")
+	for i := 0; i < 2; i++ {
+		if _, err := client.Call("Echo", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.RemovePermanentHeader("X-Api-Key")
+	if _, err := client.Call("Echo", 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"abc123", "abc123", ""}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("want headers %q but got %q", want, keys)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	echo := echoServer(t)
+	var user, pass, ua string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ = r.BasicAuth()
+		ua = r.UserAgent()
+		echo(w, r)
+	}))
+	defer ts.Close()
+
+	if _, err := NewClient(ts.URL+"/api").Call("Echo", 1); err == nil {
+		t.Fatal("want certificate error without TLS config")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	client := NewClient(ts.URL+"/api",
+		WithTimeout(time.Second),
+		WithTLSConfig(&tls.Config{RootCAs: roots}),
+		WithBasicAuth("joe", "secret"),
+		WithUserAgent("xmlrpc-test/1.0"),
+	)
+	if client.HttpClient.Timeout != time.Second {
+		t.Fatalf("want timeout 1s but got %v", client.HttpClient.Timeout)
+	}
+	if _, err := client.Call("Echo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if user != "joe" || pass != "secret" {
+		t.Fatalf("want basic auth joe:secret but got %s:%s", user, pass)
+	}
+	if ua != "xmlrpc-test/1.0" {
+		t.Fatalf("want user agent xmlrpc-test/1.0 but got %q", ua)
+	}
+}
+
+func TestBasicAuthRedirect(t *testing.T) {
+	echo := echoServer(t)
+	var auth []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		echo(w, r)
+	}))
+	defer other.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		http.Redirect(w, r, other.URL+"/api", http.StatusTemporaryRedirect)
+	}))
+	defer ts.Close()
+
+	// Use another host name for the first server, so that the redirect
+	// crosses hosts.
+	first := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	if _, err := NewClient(first+"/api", WithBasicAuth("joe", "secret")).Call("Echo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(auth) != 2 || auth[0] == "" || auth[1] != "" {
+		t.Fatalf("want credentials only for the first host but got %q", auth)
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	ts := httptest.NewUnstartedServer(echoServer(t))
+	var conns int
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns++
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	client := NewClient(ts.URL+"/api", WithKeepAlive(4, time.Minute))
+	tr := client.HttpClient.Transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 4 || tr.IdleConnTimeout != time.Minute {
+		t.Fatalf("want 4 idle connections for 1m but got %d for %v", tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Call("Echo", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns != 1 {
+		t.Fatalf("want 1 connection reused but got %d", conns)
+	}
+}
+
+func TestClientHTTP2(t *testing.T) {
+	echo := echoServer(t)
+	var proto string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		echo(w, r)
+	})
+
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	client := NewClient(ts.URL+"/api", WithTLSConfig(&tls.Config{RootCAs: roots}), WithHTTP2(false))
+	if _, err := client.Call("Echo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("want HTTP/2.0 over TLS but got %s", proto)
+	}
+
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	if _, err := NewClient(h2c.URL+"/api").Call("Echo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/1.1" {
+		t.Fatalf("want HTTP/1.1 by default but got %s", proto)
+	}
+	if _, err := NewClient(h2c.URL+"/api", WithHTTP2(true)).Call("Echo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("want h2c but got %s", proto)
+	}
+
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+	roots.AddCert(h1.Certificate())
+	if _, err := NewClient(h1.URL+"/api", WithTLSConfig(&tls.Config{RootCAs: roots}), WithHTTP2(true)).Call("Echo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/1.1" {
+		t.Fatalf("want HTTP/1.1 from a TLS server without HTTP/2 but got %s", proto)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(echoServer(t))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	if _, err := NewClient(ts.URL+"/api", WithInsecureSkipVerify()).Call("Echo", 1); err == nil {
+		t.Fatal("want handshake error without client certificate")
+	}
+	client := NewClient(ts.URL+"/api", WithInsecureSkipVerify(), WithClientCert(certFile, keyFile))
+	v, err := client.Call("Echo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v[0] != int64(1) {
+		t.Fatalf("want 1 but got %v", v[0])
+	}
+
+	client = NewClient(ts.URL+"/api", WithInsecureSkipVerify(), WithClientCert(filepath.Join(dir, "missing.crt"), keyFile))
+	if _, err := client.Call("Echo", 1); err == nil {
+		t.Fatal("want error for missing certificate file")
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	echo := echoServer(t)
+	var n int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n%3 != 0 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		echo(w, r)
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL+"/api", WithRetry(3, ExponentialBackoff(time.Millisecond, 5*time.Millisecond)))
+	v, err := client.Call("Echo", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v[0] != "hi" || n != 3 {
+		t.Fatalf("want hi after 3 attempts but got %v after %d", v[0], n)
+	}
+
+	n = 0
+	client = NewClient(ts.URL+"/api", WithRetry(2, nil))
+	if _, err := client.Call("Echo", "hi"); err == nil || n != 2 {
+		t.Fatalf("want error after 2 attempts but got %v after %d", err, n)
+	}
+
+	n = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	client = NewClient(ts.URL+"/api", WithRetry(3, func(int) time.Duration { return time.Hour }))
+	if _, err := client.CallContext(ctx, "Echo", "hi"); err != context.DeadlineExceeded || n != 1 {
+		t.Fatalf("want deadline exceeded after 1 attempt but got %v after %d", err, n)
+	}
+
+	n = 0
+	fault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		b, _ := MarshalFaultXML(4, "Too many parameters.")
+		w.Write(b)
+	}))
+	defer fault.Close()
+	client = NewClient(fault.URL, WithRetry(3, nil))
+	var f *Fault
+	if _, err := client.Call("Echo", "hi"); !errors.As(err, &f) || n != 1 {
+		t.Fatalf("want fault after 1 attempt but got %v after %d", err, n)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := b(i + 1); d != want*time.Millisecond {
+			t.Errorf("attempt %d: want %v but got %v", i+1, want*time.Millisecond, d)
+		}
+	}
+}
+
+func TestClientUse(t *testing.T) {
+	ts := httptest.NewServer(echoServer(t))
+	defer ts.Close()
+
+	var trace []string
+	record := func(name string) ClientMiddleware {
+		return func(next RoundTripFunc) RoundTripFunc {
+			return func(ctx context.Context, url, method string, req io.Reader) (io.ReadCloser, error) {
+				b, err := io.ReadAll(req)
+				if err != nil {
+					return nil, err
+				}
+				if !bytes.Contains(b, []byte("<methodName>Echo</methodName>")) {
+					t.Errorf("%s: unexpected request %s", name, b)
+				}
+				trace = append(trace, name+" "+method)
+				r, err := next(ctx, url, method, bytes.NewReader(b))
+				trace = append(trace, name+" done")
+				return r, err
+			}
+		}
+	}
+
+	client := NewClient(ts.URL + "/api")
+	client.Use(record("a"), record("b"))
+	v, err := client.Call("Echo", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v[0] != "hi" {
+		t.Fatalf("want hi but got %v", v[0])
+	}
+	want := []string{"a Echo", "b Echo", "b done", "a done"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("want %q but got %q", want, trace)
+	}
+}
+
+func TestClientGo(t *testing.T) {
+	ts := httptest.NewServer(createServer("/api", "Echo", func(args ...interface{}) (interface{}, error) {
+		if args[0] == "fail" {
+			return nil, errors.New("fail")
+		}
+		return args[0], nil
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL + "/api")
+	done := make(chan *AsyncCall, 3)
+	for _, s := range []string{"a", "b", "fail"} {
+		client.Go("Echo", []interface{}{s}, done)
+	}
+	got := map[interface{}]bool{}
+	for i := 0; i < 3; i++ {
+		ac := <-done
+		if ac.Args[0] == "fail" {
+			if ac.Error == nil {
+				t.Fatal("want error for failed call")
+			}
+			continue
+		}
+		if ac.Error != nil {
+			t.Fatal(ac.Error)
+		}
+		got[ac.Value[0]] = true
+	}
+	if !got["a"] || !got["b"] {
+		t.Fatalf("want results a and b but got %v", got)
+	}
+
+	ac := <-client.Go("Echo", []interface{}{"c"}, nil).Done
+	if ac.Error != nil || ac.Value[0] != "c" {
+		t.Fatalf("want c but got %#v, %v", ac.Value, ac.Error)
+	}
+}
+
 func TestAddString(t *testing.T) {
 	ts := httptest.NewServer(createServer("/api", "AddString", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 2 {
@@ -148,9 +591,1326 @@ func TestAddString(t *testing.T) {
 	}
 }
 
+type testUUID [4]byte
+
+func TestRegisterEncoderDecoder(t *testing.T) {
+	uuidType := reflect.TypeOf(testUUID{})
+	RegisterEncoder(uuidType, func(w io.Writer, v interface{}) error {
+		_, err := fmt.Fprintf(w, "<string>uuid:%x</string>", v.(testUUID))
+		return err
+	})
+	defer RegisterEncoder(uuidType, nil)
+	RegisterDecoder(reflect.TypeOf(""), func(s string) (interface{}, error) {
+		b, err := hex.DecodeString(strings.TrimPrefix(s, "uuid:"))
+		if !strings.HasPrefix(s, "uuid:") || err != nil || len(b) != 4 {
+			return s, nil
+		}
+		var u testUUID
+		copy(u[:], b)
+		return u, nil
+	})
+	defer RegisterDecoder(reflect.TypeOf(""), nil)
+
+	var buf strings.Builder
+	if err := Marshal(&buf, "get", testUUID{1, 2, 3, 4}, "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<string>uuid:01020304</string>") {
+		t.Fatalf("encoder not used: %s", buf.String())
+	}
+	_, v, err := Unmarshal(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Array{testUUID{1, 2, 3, 4}, "plain"}); !reflect.DeepEqual(v, want) {
+		t.Fatalf("want %#v but got %#v", want, v)
+	}
+}
+
+func TestDecoderRegisterDecoder(t *testing.T) {
+	upper := func(s string) (interface{}, error) { return strings.ToUpper(s), nil }
+	const resp = `<?xml version="1.0"?><methodResponse><params><param><value><string>abc</string></value></param></params></methodResponse>`
+
+	d := NewDecoder(strings.NewReader(resp))
+	d.RegisterDecoder(reflect.TypeOf(""), upper)
+	if _, v, err := d.Decode(); err != nil || v[0] != "ABC" {
+		t.Fatalf("want ABC but got %#v, %v", v, err)
+	}
+	if _, v, err := Unmarshal(strings.NewReader(resp)); err != nil || v[0] != "abc" {
+		t.Fatalf("other decoders affected: got %#v, %v", v, err)
+	}
+
+	RegisterDecoder(reflect.TypeOf(""), upper)
+	defer RegisterDecoder(reflect.TypeOf(""), nil)
+	d = NewDecoder(strings.NewReader(resp))
+	d.RegisterDecoder(reflect.TypeOf(""), nil)
+	if _, v, err := d.Decode(); err != nil || v[0] != "abc" {
+		t.Fatalf("want abc but got %#v, %v", v, err)
+	}
+
+	_, _, err := Unmarshal(strings.NewReader(`<?xml version="1.0"?><methodResponse><fault><value><struct>
+	<member><name>faultCode</name><value><int>4</int></value></member>
+	<member><name>faultString</name><value><string>oops</string></value></member>
+	</struct></value></fault></methodResponse>`))
+	var f *Fault
+	if !errors.As(err, &f) || f.Message != "oops" {
+		t.Fatalf("want fault oops but got %v", err)
+	}
+}
+
+func TestWriteXMLSlice(t *testing.T) {
+	const want = "<array><data><value><int>1</int></value><value><string>a</string></value></data></array>"
+	for _, v := range []interface{}{Array{1, "a"}, []interface{}{1, "a"}, [2]interface{}{1, "a"}} {
+		if got := toXml(v, true); got != want {
+			t.Errorf("%#v: want %q but got %q", v, want, got)
+		}
+	}
+}
+
+func TestWriteXMLUnwrap(t *testing.T) {
+	var inner interface{} = "s"
+	outer := reflect.ValueOf(&inner).Elem() // interface{} holding a string
+	for _, v := range []interface{}{
+		outer,
+		reflect.ValueOf(outer),
+		reflect.ValueOf(reflect.ValueOf(outer)),
+	} {
+		if got := toXml(v, true); got != "<string>s</string>" {
+			t.Errorf("%#v: want %q but got %q", v, "<string>s</string>", got)
+		}
+	}
+
+	var nilIface interface{}
+	if got := toXml(reflect.ValueOf(&nilIface).Elem(), true); got != "<nil/>" {
+		t.Errorf("want <nil/> but got %q", got)
+	}
+
+	var deep interface{} = "s"
+	for i := 0; i < 2*maxUnwrapDepth; i++ {
+		deep = reflect.ValueOf(deep)
+	}
+	if err := NewEncoder(io.Discard).writeXML(deep, true); err == nil {
+		t.Error("want error for too deeply wrapped value")
+	}
+}
+
+func TestNil(t *testing.T) {
+	var nilPtr *int
+	var nilIface error
+	i := 42
+	var buf strings.Builder
+	if err := Marshal(&buf, "", Nil, nil, nilPtr, nilIface, &i, Struct{"none": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "<nil/>"); n != 5 {
+		t.Fatalf("want 5 <nil/> but got %d in %s", n, buf.String())
+	}
+	_, v, err := Unmarshal(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Array{nil, nil, nil, nil, int64(42), Struct{"none": nil}}); !reflect.DeepEqual(v, want) {
+		t.Fatalf("want %#v but got %#v", want, v)
+	}
+}
+
+func TestWriteXMLBase64(t *testing.T) {
+	type blob []byte
+	for _, v := range []interface{}{[]byte{1}, blob{1}} {
+		if got := toXml(v, true); got != "<base64>AQ==</base64>" {
+			t.Errorf("%#v: want %q but got %q", v, "<base64>AQ==</base64>", got)
+		}
+	}
+}
+
+func TestWriteXMLStructTags(t *testing.T) {
+	type post struct {
+		ID      int    `xmlrpc:"post_id"`
+		Title   string `xmlrpc:"title,omitempty"`
+		Status  string `xmlrpc:",omitempty"`
+		Secret  string `xmlrpc:"-"`
+		Author  string
+		private int
+	}
+	for _, tc := range []struct {
+		v    post
+		want string
+	}{
+		{post{ID: 1, Title: "Hello", Status: "draft", Secret: "x", Author: "me"},
+			"<struct><member><name>post_id</name><value><int>1</int></value></member>" +
+				"<member><name>title</name><value><string>Hello</string></value></member>" +
+				"<member><name>Status</name><value><string>draft</string></value></member>" +
+				"<member><name>Author</name><value><string>me</string></value></member></struct>"},
+		{post{ID: 2},
+			"<struct><member><name>post_id</name><value><int>2</int></value></member>" +
+				"<member><name>Author</name><value><string></string></value></member></struct>"},
+	} {
+		if got := toXml(tc.v, true); got != tc.want {
+			t.Errorf("%#v:\nwant %s\n got %s", tc.v, tc.want, got)
+		}
+	}
+}
+
+func TestWriteXMLEmbedded(t *testing.T) {
+	type Common struct {
+		ID     int `xmlrpc:"id"`
+		Status string
+	}
+	type Meta struct {
+		Status string `xmlrpc:"Status"`
+		Views  int
+	}
+	type hidden struct {
+		Secret string
+	}
+	type Response struct {
+		Common
+		*Meta
+		hidden
+		Extra string
+		Views int
+	}
+
+	for _, tc := range []struct {
+		v    Response
+		want string
+	}{
+		{Response{Common: Common{ID: 1, Status: "ok"}, Meta: &Meta{Status: "draft", Views: 2}, hidden: hidden{"x"}, Extra: "e", Views: 3},
+			// The tagged Status wins, the least nested Views wins.
+			"<struct><member><name>id</name><value><int>1</int></value></member>" +
+				"<member><name>Status</name><value><string>draft</string></value></member>" +
+				"<member><name>Extra</name><value><string>e</string></value></member>" +
+				"<member><name>Views</name><value><int>3</int></value></member></struct>"},
+		{Response{Common: Common{ID: 2}},
+			// Status is in the nil *Meta.
+			"<struct><member><name>id</name><value><int>2</int></value></member>" +
+				"<member><name>Extra</name><value><string></string></value></member>" +
+				"<member><name>Views</name><value><int>0</int></value></member></struct>"},
+	} {
+		if got := toXml(tc.v, true); got != tc.want {
+			t.Errorf("%#v:\nwant %s\n got %s", tc.v, tc.want, got)
+		}
+	}
+
+	type A struct{ Name string }
+	type B struct{ Name string }
+	type Both struct {
+		A
+		B
+		Tagged A `xmlrpc:"a"`
+	}
+	want := "<struct><member><name>a</name><value><struct><member><name>Name</name><value><string>z</string></value></member></struct></value></member></struct>"
+	if got := toXml(Both{A{"x"}, B{"y"}, A{"z"}}, true); got != want {
+		t.Errorf("want %s\n got %s", want, got)
+	}
+}
+
+func BenchmarkWriteXMLStruct(b *testing.B) {
+	type post struct {
+		ID     int    `xmlrpc:"post_id"`
+		Title  string `xmlrpc:"title,omitempty"`
+		Status string
+	}
+	v := post{ID: 1, Title: "Hello", Status: "publish"}
+	enc := NewEncoder(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := enc.writeXML(v, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteXMLStringer(t *testing.T) {
+	u, _ := url.Parse("http://example.com/xmlrpc?a=1&b=2")
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{net.ParseIP("192.168.1.1"), "<string>192.168.1.1</string>"},
+		{net.ParseIP("::1"), "<string>::1</string>"},
+		{net.IP(nil), "<nil/>"},
+		{u, "<string>http://example.com/xmlrpc?a=1&amp;b=2</string>"},
+		{*u, "<string>http://example.com/xmlrpc?a=1&amp;b=2</string>"},
+	} {
+		if got := toXml(tc.v, true); got != tc.want {
+			t.Errorf("%#v: want %q but got %q", tc.v, tc.want, got)
+		}
+	}
+}
+
+type level int
+
+func (l level) MarshalText() ([]byte, error) {
+	if l < 0 {
+		return nil, errors.New("negative level")
+	}
+	return []byte(strings.Repeat("*", int(l))), nil
+}
+
+func TestWriteXMLTextMarshaler(t *testing.T) {
+	n, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{level(3), "<string>***</string>"},
+		{Struct{"level": level(1)}, "<struct><member><name>level</name><value><string>*</string></value></member></struct>"},
+		{n, "<string>123456789012345678901234567890</string>"},
+	} {
+		if got := toXml(tc.v, true); got != tc.want {
+			t.Errorf("%#v: want %q but got %q", tc.v, tc.want, got)
+		}
+	}
+	if err := Marshal(io.Discard, "f", level(-1)); err == nil || err.Error() != "negative level" {
+		t.Fatalf("want MarshalText error but got %v", err)
+	}
+}
+
+type Money struct {
+	cents int64
+}
+
+func (m Money) MarshalXMLRPC() (interface{}, error) {
+	return float64(m.cents) / 100, nil
+}
+
+type loop struct{}
+
+func (l loop) MarshalXMLRPC() (interface{}, error) { return l, nil }
+
+func TestMarshaler(t *testing.T) {
+	if got, want := toXml(Money{1234}, true), "<double>12.34</double>"; got != want {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+	b, err := MarshalTo("pay", Struct{"amount": &Money{-50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, v, err := UnmarshalBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v[0].(Struct)["amount"]; got != -0.5 {
+		t.Fatalf("want -0.5 but got %#v", got)
+	}
+	if _, err := MarshalTo("f", loop{}); err == nil {
+		t.Fatal("want error for MarshalXMLRPC returning its own type")
+	}
+}
+
+func TestHandlerFunc(t *testing.T) {
+	var h Handler = HandlerFunc(func(method string, params []interface{}) (interface{}, *Fault) {
+		if method != "echo" {
+			return nil, &Fault{Code: -32601, Message: "method not found"}
+		}
+		return params[0], nil
+	})
+	if v, f := h.ServeXMLRPC("echo", []interface{}{"hello"}); f != nil || v != "hello" {
+		t.Fatalf("want %q but got %#v, %v", "hello", v, f)
+	}
+	if _, f := h.ServeXMLRPC("other", nil); f == nil || f.Code != -32601 {
+		t.Fatalf("want method not found fault but got %v", f)
+	}
+}
+
+func TestFaultIs(t *testing.T) {
+	errNotFound := &Fault{Code: 404}
+	err := fmt.Errorf("getPost: %w", &Fault{Code: 404, Message: "post 42 not found"})
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("want %v to match %v", err, errNotFound)
+	}
+	if errors.Is(err, &Fault{Code: 403}) {
+		t.Fatalf("%v should not match fault 403", err)
+	}
+	if !errors.Is(err, FaultCode(404)) {
+		t.Fatalf("want %v to match FaultCode(404)", err)
+	}
+	if errors.Is(err, (*Fault)(nil)) {
+		t.Fatalf("%v should not match a nil fault", err)
+	}
+}
+
+func TestHTTPRequestResponse(t *testing.T) {
+	var body strings.Builder
+	if err := Marshal(&body, "AddInt", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(contentType string) *http.Request {
+		r := httptest.NewRequest("POST", "/RPC2", strings.NewReader(body.String()))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+
+	name, params, err := UnmarshalHTTPRequest(newRequest("text/xml; charset=utf-8"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "AddInt" || len(params) != 2 {
+		t.Fatalf("want AddInt(1, 2) but got %s(%#v)", name, params)
+	}
+	if _, _, err = UnmarshalHTTPRequest(newRequest("application/json"), 1<<20); err != ErrWrongContentType {
+		t.Fatalf("want %v but got %v", ErrWrongContentType, err)
+	}
+	if _, _, err = UnmarshalHTTPRequest(newRequest("text/xml"), 16); err != ErrBodyTooLarge {
+		t.Fatalf("want %v but got %v", ErrBodyTooLarge, err)
+	}
+
+	w := httptest.NewRecorder()
+	if err = MarshalHTTPResponse(w, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, err := Unmarshal(w.Body); err != nil || len(v) != 1 || v[0] != int64(3) {
+		t.Fatalf("want [3] but got %#v, %v", v, err)
+	}
+	w = httptest.NewRecorder()
+	if err = MarshalHTTPResponse(w, nil, &Fault{Code: -32601, Message: "method not found"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Unmarshal(w.Body); !errors.Is(err, &Fault{Code: -32601}) {
+		t.Fatalf("want method not found fault but got %v", err)
+	}
+}
+
+func TestMarshalFaultXML(t *testing.T) {
+	b, err := MarshalFaultXML(-32601, "method <foo> not found")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(xmlDeclaration+"<methodResponse><fault>")) {
+		t.Fatalf("unexpected fault document %s", b)
+	}
+	_, _, err = Unmarshal(bytes.NewReader(b))
+	if f, ok := err.(*Fault); !ok || f.Code != -32601 || f.Message != "method <foo> not found" {
+		t.Fatalf("want fault but got %#v", err)
+	}
+}
+
+func TestMarshalNilFault(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Marshal(&buf, "", (*Fault)(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<params><param><value><nil/></value></param></params>") {
+		t.Fatalf("want nil param but got %s", buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	if err := MarshalHTTPResponse(w, (*Fault)(nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, err := Unmarshal(w.Body); err != nil || len(v) != 1 || v[0] != nil {
+		t.Fatalf("want [nil] but got %#v, %v", v, err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	err := (&Fault{Code: -32601, Message: "no such method <x>"}).ToHTTPError()
+	if err.StatusCode() != http.StatusNotFound {
+		t.Fatalf("want status %d but got %d", http.StatusNotFound, err.StatusCode())
+	}
+
+	w := httptest.NewRecorder()
+	if e := err.WriteResponse(w); e != nil {
+		t.Fatal(e)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("want status %d but got %d", http.StatusNotFound, w.Code)
+	}
+	_, _, e := Unmarshal(w.Body)
+	f, ok := e.(*Fault)
+	if !ok || *f != *err.Fault {
+		t.Fatalf("want %#v but got %#v", err.Fault, e)
+	}
+}
+
+func TestEncoderSortStructKeys(t *testing.T) {
+	a := map[string]interface{}{}
+	b := map[string]interface{}{}
+	keys := []string{"delta", "alpha", "charlie", "bravo", "echo"}
+	for i := range keys {
+		a[keys[i]] = i
+		b[keys[len(keys)-1-i]] = len(keys) - 1 - i
+	}
+	encode := func(m map[string]interface{}) string {
+		var buf strings.Builder
+		enc := NewEncoder(&buf)
+		enc.SetSortStructKeys(true)
+		if err := enc.writeXML(m, true); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	first := encode(a)
+	if second := encode(b); first != second {
+		t.Fatalf("want identical output but got\n%s\n%s", first, second)
+	}
+	if i, j := strings.Index(first, "alpha"), strings.Index(first, "echo"); i < 0 || j < i {
+		t.Fatalf("members are not sorted: %s", first)
+	}
+}
+
+func TestMarshalWithOptions(t *testing.T) {
+	args := []interface{}{" a b ", Struct{"n": 1}, Array{}, nil}
+	var buf bytes.Buffer
+	if err := MarshalWithOptions(&buf, "f", MarshalOptions{Indent: "  "}, args...); err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<methodCall>
+  <methodName>f</methodName>
+  <params>
+    <param>
+      <value>
+        <string> a b </string>
+      </value>
+    </param>
+    <param>
+      <value>
+        <struct>
+          <member>
+            <name>n</name>
+            <value>
+              <int>1</int>
+            </value>
+          </member>
+        </struct>
+      </value>
+    </param>
+    <param>
+      <value>
+        <array>
+          <data></data>
+        </array>
+      </value>
+    </param>
+    <param>
+      <value>
+        <nil/>
+      </value>
+    </param>
+  </params>
+</methodCall>`
+	if buf.String() != want {
+		t.Fatalf("want\n%s\ngot\n%s", want, buf.String())
+	}
+	name, v, err := Unmarshal(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Array{" a b ", Struct{"n": int64(1)}, Array(nil), nil}); name != "f" || !reflect.DeepEqual(v, want) {
+		t.Fatalf("want f %#v but got %s %#v", want, name, v)
+	}
+
+	var compact, plain bytes.Buffer
+	if err := MarshalWithOptions(&compact, "f", MarshalOptions{Compact: true, Indent: "  "}, args...); err != nil {
+		t.Fatal(err)
+	}
+	if err := Marshal(&plain, "f", args...); err != nil {
+		t.Fatal(err)
+	}
+	if compact.String() != plain.String() || strings.Contains(plain.String(), "\n") {
+		t.Fatalf("want compact output but got %s and %s", compact.String(), plain.String())
+	}
+}
+
+func TestMarshalXMLDeclaration(t *testing.T) {
+	var buf strings.Builder
+	if err := Marshal(&buf, "noop"); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); !strings.HasPrefix(s, `<?xml version="1.0" encoding="UTF-8"?><methodCall>`) {
+		t.Fatalf("missing XML declaration in %q", s)
+	}
+
+	buf.Reset()
+	enc := NewEncoder(&buf)
+	enc.OmitXMLDeclaration(true)
+	if err := enc.Encode("noop"); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); !strings.HasPrefix(s, "<methodCall>") {
+		t.Fatalf("want no XML declaration but got %q", s)
+	}
+}
+
+func TestUnmarshalNoParams(t *testing.T) {
+	var buf strings.Builder
+	if err := Marshal(&buf, "noargs"); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{
+		buf.String(),
+		`<?xml version="1.0"?><methodCall><methodName>noargs</methodName><params/></methodCall>`,
+		`<?xml version="1.0"?><methodCall><methodName>noargs</methodName><params></params></methodCall>`,
+	} {
+		name, v, err := Unmarshal(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if name != "noargs" || len(v) != 0 {
+			t.Fatalf("%s: want noargs() but got %s(%#v)", input, name, v)
+		}
+	}
+}
+
+func TestUnmarshalParseError(t *testing.T) {
+	input := `<?xml version="1.0"?><methodCall><methodName>blog.getPost</methodName>
+	<params><param><value>` + strings.Repeat("<string>padding</string>", 10) + `</value></params></methodCall>`
+	_, _, err := Unmarshal(strings.NewReader(input))
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("want *ParseError but got %#v", err)
+	}
+	var se *xml.SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatalf("want wrapped *xml.SyntaxError in %v", err)
+	}
+	if pe.Method != "blog.getPost" || pe.Line != 2 {
+		t.Fatalf("want method blog.getPost on line 2 but got %q on %d", pe.Method, pe.Line)
+	}
+	if len(pe.Context) != 100 || !strings.HasSuffix(pe.Context, "</value></params>") {
+		t.Fatalf("unexpected context %q", pe.Context)
+	}
+	if pe.Offset != int64(strings.Index(input, "</params>")+len("</params>")) {
+		t.Fatalf("unexpected offset %d in %s", pe.Offset, input)
+	}
+}
+
+func TestUnmarshalMemberOrder(t *testing.T) {
+	_, v, err := Unmarshal(strings.NewReader(`<?xml version="1.0"?>
+	<methodResponse><params><param><value><array><data>
+		<value><struct>
+			<member><value><string>active</string></value><name>status</name></member>
+			<member><name>id</name><value><int>1</int></value></member>
+		</struct></value>
+		<value><struct>
+			<member><value><string>deleted</string></value><name>status</name></member>
+		</struct></value>
+	</data></array></value></param></params></methodResponse>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Array{Array{
+		Struct{"status": "active", "id": int64(1)},
+		Struct{"status": "deleted"},
+	}}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("want %#v but got %#v", want, v)
+	}
+}
+
+func TestUnmarshalBareString(t *testing.T) {
+	_, v, err := Unmarshal(strings.NewReader(`<?xml version="1.0"?>
+	<methodResponse><params>
+		<param><value>hello world</value></param>
+		<param><value> spaced &amp; escaped </value></param>
+		<param><value></value></param>
+		<param><value>
+			<int>42</int>
+		</value></param>
+		<param><value><struct>
+			<member><name>title</name><value>Hello</value></member>
+		</struct></value></param>
+		<param><value><array><data><value>a</value><value><string>b</string></value></data></array></value></param>
+	</params></methodResponse>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Array{
+		"hello world",
+		" spaced & escaped ",
+		"",
+		int64(42),
+		Struct{"title": "Hello"},
+		Array{"a", "b"},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("want %#v but got %#v", want, v)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	if err := Marshal(io.Discard, "f", make(chan int)); !errors.Is(err, ErrUnsupportedType) || !errors.Is(err, UnsupportedType) {
+		t.Fatalf("want ErrUnsupportedType but got %v", err)
+	}
+	if err := Marshal(io.Discard, "f", map[int]string{1: "a"}); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("want ErrUnsupportedType for map[int]string but got %v", err)
+	}
+	for _, tc := range []struct {
+		input string
+		want  error
+	}{
+		{`<methodRequest/>`, ErrNameMismatch},
+		{`<methodCall><params/></methodCall>`, ErrNameMismatch},
+		{`<methodResponse><params><param><value><struct><member><name>a</name></member></struct></value></param></params></methodResponse>`, ErrNotStartElement},
+		{`<methodResponse><fault><value><string>oops</string></value></fault></methodResponse>`, ErrMalformedFault},
+	} {
+		if _, _, err := Unmarshal(strings.NewReader(tc.input)); !errors.Is(err, tc.want) {
+			t.Errorf("%s: want %v but got %v", tc.input, tc.want, err)
+		}
+	}
+}
+
+func TestInvalidFloat(t *testing.T) {
+	for _, f := range []interface{}{math.NaN(), math.Inf(1), float32(math.Inf(-1))} {
+		if err := Marshal(io.Discard, "f", f); !errors.Is(err, ErrInvalidFloat) {
+			t.Errorf("%v: want ErrInvalidFloat but got %v", f, err)
+		}
+	}
+	for _, s := range []string{"abc", "NaN", "+Inf", "1.5.2", ""} {
+		_, _, err := Unmarshal(strings.NewReader(`<methodResponse><params><param><value><double>` + s + `</double></value></param></params></methodResponse>`))
+		if !errors.Is(err, ErrInvalidFloat) || !strings.Contains(err.Error(), strconv.Quote(s)) {
+			t.Errorf("%q: want ErrInvalidFloat but got %v", s, err)
+		}
+	}
+}
+
+func TestUnmarshalLimits(t *testing.T) {
+	param := `<param><value><int>1</int></value></param>`
+	member := `<member><name>a</name><value><int>1</int></value></member>`
+	params := func(n int) string {
+		return `<?xml version="1.0"?><methodResponse><params>` + strings.Repeat(param, n) + `</params></methodResponse>`
+	}
+	structOf := func(members string) string {
+		return `<?xml version="1.0"?><methodResponse><params><param><value><struct>` +
+			members + `</struct></value></param></params></methodResponse>`
+	}
+	for _, tc := range []struct {
+		input string
+		ok    bool
+	}{
+		{params(2), true},
+		{params(3), false},
+		{structOf(strings.Repeat(member, 2)), true},
+		{structOf(strings.Repeat(member, 3)), false},
+		// Only <member> children count towards the limit.
+		{structOf(member + "<junk/><junk/>" + member), true},
+	} {
+		d := NewDecoder(strings.NewReader(tc.input))
+		d.SetMaxParams(2)
+		d.SetMaxStructMembers(2)
+		_, _, err := d.Decode()
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.input, err)
+		} else if !tc.ok && !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: want ErrLimitExceeded but got %v", tc.input, err)
+		}
+		var f *Fault
+		if errors.As(err, &f) {
+			t.Errorf("%s: want a local error, not a fault", tc.input)
+		}
+	}
+}
+
+func TestUnmarshalBareValue(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want Array
+	}{
+		{`<value><int>42</int></value>`, Array{int64(42)}},
+		{`<value>42</value>`, Array{"42"}},
+		{`<value><array><data><value>a</value></data></array></value>`, Array{Array{"a"}}},
+		{`<params><param><value><int>42</int></value></param></params>`, Array{int64(42)}},
+	} {
+		_, v, err := Unmarshal(strings.NewReader(`<?xml version="1.0"?><methodResponse>` + tc.body + `</methodResponse>`))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.body, err)
+		}
+		if !reflect.DeepEqual(v, tc.want) {
+			t.Errorf("%s: want %#v but got %#v", tc.body, tc.want, v)
+		}
+	}
+}
+
+func TestUnmarshalBOM(t *testing.T) {
+	doc := []byte("\xef\xbb\xbf" + `<?xml version="1.0" encoding="UTF-8"?>
+	<methodResponse><params><param><value><int>42</int></value></param></params></methodResponse>`)
+	_, v, err := UnmarshalBytes(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v[0] != int64(42) {
+		t.Fatalf("want 42 but got %v", v[0])
+	}
+
+	_, _, err = UnmarshalBytes([]byte("\xef\xbb\xbf<methodResponse><params></param>"))
+	var pe *ParseError
+	if !errors.As(err, &pe) || strings.HasPrefix(pe.Context, "\xef\xbb\xbf") {
+		t.Fatalf("want ParseError without BOM in context but got %#v", err)
+	}
+}
+
+func TestUnmarshalNestingDepth(t *testing.T) {
+	nested := func(n int, open, close string) string {
+		return `<methodResponse><params><param><value>` +
+			strings.Repeat(open, n) + `<int>1</int>` + strings.Repeat(close, n) +
+			`</value></param></params></methodResponse>`
+	}
+	arrays := func(n int) string { return nested(n, `<array><data><value>`, `</value></data></array>`) }
+	// params, param, value, then array and value for each level, then int.
+	if _, _, err := Unmarshal(strings.NewReader(arrays(48))); err != nil {
+		t.Fatalf("want 48 levels accepted but got %v", err)
+	}
+	for name, input := range map[string]string{
+		"arrays":      arrays(49),
+		"deep arrays": arrays(10000),
+		"values":      nested(1000000, `<value>`, `</value>`),
+		"params":      nested(1000000, `<param>`, `</param>`),
+	} {
+		if _, _, err := Unmarshal(strings.NewReader(input)); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%s: want ErrLimitExceeded but got %v", name, err)
+		}
+	}
+
+	d := NewDecoder(strings.NewReader(arrays(2)))
+	d.SetMaxNestingDepth(8)
+	if _, _, err := d.Decode(); err != nil {
+		t.Fatalf("want 2 levels accepted but got %v", err)
+	}
+	d = NewDecoder(strings.NewReader(arrays(3)))
+	d.SetMaxNestingDepth(8)
+	if _, _, err := d.Decode(); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("want ErrLimitExceeded for 3 levels but got %v", err)
+	}
+}
+
+func TestUnmarshalFaultTolerant(t *testing.T) {
+	member := func(name, value string) string {
+		return "<member><name>" + name + "</name><value>" + value + "</value></member>"
+	}
+	for _, tc := range []struct {
+		members string
+		want    Fault
+	}{
+		{member("faultCode", "<int>4</int>") + member("faultString", "<string>Too many parameters.</string>"), Fault{4, "Too many parameters."}},
+		{member("faultString", "<string>no code</string>"), Fault{-1, "no code"}},
+		{member("faultCode", "<int>7</int>"), Fault{7, "unknown fault"}},
+		{"", Fault{-1, "unknown fault"}},
+		{member("FaultCode", "<string>12</string>") + member("faultstring", "oops"), Fault{12, "oops"}},
+		{member("faultCode", "<string>E_FAIL</string>") + member("faultString", "<int>3</int>"), Fault{-1, "3"}},
+	} {
+		_, _, err := Unmarshal(strings.NewReader(`<?xml version="1.0"?>
+		<methodResponse><fault><value><struct>` + tc.members + `</struct></value></fault></methodResponse>`))
+		var f *Fault
+		if !errors.As(err, &f) {
+			t.Fatalf("%s: want *Fault but got %v", tc.members, err)
+		}
+		if *f != tc.want {
+			t.Errorf("%s: want %#v but got %#v", tc.members, tc.want, *f)
+		}
+	}
+}
+
+func TestUnmarshalFaultCoerce(t *testing.T) {
+	const input = `<?xml version="1.0"?>
+	<methodResponse><params><param><value><struct>
+		<member><name>faultCode</name><value><int>403</int></value></member>
+		<member><name>faultString</name><value><string>Incorrect username or password.</string></value></member>
+	</struct></value></param></params></methodResponse>`
+
+	if _, v, err := Unmarshal(strings.NewReader(input)); err != nil || len(v) != 1 {
+		t.Fatalf("want a single param without coercion but got %#v, %v", v, err)
+	}
+
+	d := NewDecoder(strings.NewReader(input))
+	d.SetFaultCoerce(true)
+	_, _, err := d.Decode()
+	f, ok := err.(*Fault)
+	if !ok {
+		t.Fatalf("want *Fault but got %#v", err)
+	}
+	if f.Code != 403 || f.Message != "Incorrect username or password." {
+		t.Fatalf("unexpected fault %#v", f)
+	}
+}
+
+func TestUnmarshalIntType(t *testing.T) {
+	const input = `<?xml version="1.0"?><methodResponse><params>
+		<param><value><int>1</int></value></param>
+		<param><value><i4>-2</i4></value></param>
+		<param><value><i8>3</i8></value></param>
+	</params></methodResponse>`
+	for _, tc := range []struct {
+		typ  IntType
+		want Array
+	}{
+		{IntType64, Array{int64(1), int64(-2), int64(3)}},
+		{IntType32, Array{int32(1), int32(-2), int64(3)}},
+		{IntTypeNative, Array{1, -2, int64(3)}},
+	} {
+		d := NewDecoder(strings.NewReader(input))
+		d.SetIntType(tc.typ)
+		_, v, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, tc.want) {
+			t.Errorf("%d: want %#v but got %#v", tc.typ, tc.want, v)
+		}
+	}
+}
+
+func TestI8RoundTrip(t *testing.T) {
+	defer func() { UseI8ForInt64 = false }()
+	type testCase struct {
+		v       interface{}
+		useI8   bool
+		tag     string
+		decoded int64
+	}
+	cases := []testCase{
+		{int64(math.MaxInt32), false, "<int>", math.MaxInt32},
+		{int64(math.MaxInt32 + 1), false, "<i8>", math.MaxInt32 + 1},
+		{int64(math.MinInt32 - 1), false, "<i8>", math.MinInt32 - 1},
+		{int64(math.MinInt64), false, "<i8>", math.MinInt64},
+		{uint64(math.MaxInt32 + 1), false, "<i8>", math.MaxInt32 + 1},
+		{int64(1), true, "<i8>", 1},
+		{int32(1), true, "<int>", 1},
+	}
+	if strconv.IntSize == 64 {
+		big := int64(math.MaxInt32 + 1)
+		cases = append(cases, testCase{int(big), false, "<i8>", big})
+	}
+	for _, tc := range cases {
+		UseI8ForInt64 = tc.useI8
+		var buf strings.Builder
+		if err := Marshal(&buf, "", tc.v); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), tc.tag) {
+			t.Errorf("%#v: want %s in %s", tc.v, tc.tag, buf.String())
+		}
+		_, v, err := Unmarshal(strings.NewReader(buf.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[0] != tc.decoded {
+			t.Errorf("%#v: want %d but got %#v", tc.v, tc.decoded, v[0])
+		}
+	}
+	if err := Marshal(io.Discard, "", uint64(math.MaxUint64)); err == nil {
+		t.Error("want overflow error for MaxUint64")
+	}
+}
+
+func TestUnmarshalDateOnly(t *testing.T) {
+	want := time.Date(2013, 10, 15, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value   string
+		formats []string
+	}{
+		{value: "20131015"},
+		{value: "2013-10-15"},
+		{value: "15.10.2013", formats: []string{"02.01.2006"}},
+	} {
+		d := NewDecoder(strings.NewReader(`<?xml version="1.0"?>
+		<methodResponse><params><param><value><struct>
+			<member><name>dateCreated</name><value><dateTime.iso8601>` + tc.value + `</dateTime.iso8601></value></member>
+		</struct></value></param></params></methodResponse>`))
+		if tc.formats != nil {
+			d.SetDateOnlyFormats(tc.formats)
+		}
+		_, v, err := d.Decode()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.value, err)
+		}
+		got, _ := v[0].(Struct)["dateCreated"].(time.Time)
+		if !got.Equal(want) {
+			t.Fatalf("%s: want %v but got %v", tc.value, want, got)
+		}
+	}
+}
+
+func TestDateTimeRoundTrip(t *testing.T) {
+	ref := time.Date(2013, 10, 15, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		in   time.Time
+		want string
+	}{
+		{"utc", ref, "2013-10-15T12:30:00Z"},
+		{"east", ref.In(time.FixedZone("IST", 5*3600+1800)), "2013-10-15T18:00:00+05:30"},
+		{"west", ref.In(time.FixedZone("EDT", -4*3600)), "2013-10-15T08:30:00-04:00"},
+		{"local", ref.In(time.Local), ref.In(time.Local).Format(time.RFC3339)},
+	} {
+		var buf bytes.Buffer
+		if err := Marshal(&buf, "set", tc.in); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if want := "<dateTime.iso8601>" + tc.want + "</dateTime.iso8601>"; !strings.Contains(buf.String(), want) {
+			t.Fatalf("%s: want %s in %s", tc.name, want, buf.String())
+		}
+		_, v, err := Unmarshal(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, _ := v[0].(time.Time)
+		if !got.Equal(tc.in) {
+			t.Fatalf("%s: want %v but got %v", tc.name, tc.in, got)
+		}
+		_, wantOff := tc.in.Zone()
+		if _, off := got.Zone(); off != wantOff {
+			t.Fatalf("%s: want offset %d but got %d", tc.name, wantOff, off)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "PT0S"},
+		{90 * time.Minute, "PT1H30M"},
+		{36*time.Hour + 5*time.Second, "PT36H5S"},
+		{1500 * time.Millisecond, "PT1.5S"},
+		{-time.Nanosecond, "-PT0.000000001S"},
+		{math.MaxInt64, "PT2562047H47M16.854775807S"},
+	} {
+		if got := toXml(tc.d, true); got != "<string>"+tc.want+"</string>" {
+			t.Errorf("%v: want %s but got %s", tc.d, tc.want, got)
+		}
+		if d, err := ParseISODuration(tc.want); err != nil || d != tc.d {
+			t.Errorf("%s: want %v but got %v, %v", tc.want, tc.d, d, err)
+		}
+	}
+	for s, want := range map[string]time.Duration{
+		"P1DT12H":  36 * time.Hour,
+		"P1W":      7 * 24 * time.Hour,
+		"PT0,5S":   500 * time.Millisecond,
+		"+PT1M":    time.Minute,
+		"-P1DT1S":  -(24*time.Hour + time.Second),
+		"PT1.25H":  75 * time.Minute,
+		"PT90M30S": 90*time.Minute + 30*time.Second,
+	} {
+		if d, err := ParseISODuration(s); err != nil || d != want {
+			t.Errorf("%s: want %v but got %v, %v", s, want, d, err)
+		}
+	}
+	for _, s := range []string{"", "P", "PT", "1H", "P1Y", "P1M", "PT1D", "P1H", "PTH", "PT1.5.5S", "PT9999999999H"} {
+		if d, err := ParseISODuration(s); err == nil {
+			t.Errorf("%q: want error but got %v", s, d)
+		}
+	}
+}
+
+func TestRegisterDateTimeFormat(t *testing.T) {
+	defer func() {
+		ClearDateTimeFormats()
+		for _, f := range DefaultDateTimeFormats() {
+			RegisterDateTimeFormat(f)
+		}
+	}()
+	parse := func(s string) (time.Time, error) {
+		_, v, err := Unmarshal(strings.NewReader(`<?xml version="1.0"?>
+		<methodResponse><params><param><value><dateTime.iso8601>` + s + `</dateTime.iso8601></value></param></params></methodResponse>`))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return v[0].(time.Time), nil
+	}
+
+	want := time.Date(2013, 10, 15, 12, 30, 0, 0, time.UTC)
+	if _, err := parse("2013-10-15 12:30:00"); err == nil {
+		t.Fatal("want error for unregistered format")
+	}
+	RegisterDateTimeFormat("2006-01-02 15:04:05")
+	if got, err := parse("2013-10-15 12:30:00"); err != nil || !got.Equal(want) {
+		t.Fatalf("want %v but got %v, %v", want, got, err)
+	}
+	if got, err := parse("20131015T12:30:00"); err != nil || !got.Equal(want) {
+		t.Fatalf("want %v but got %v, %v", want, got, err)
+	}
+
+	ClearDateTimeFormats()
+	if _, err := parse("20131015T12:30:00"); err == nil {
+		t.Fatal("want error after ClearDateTimeFormats")
+	}
+}
+
+func TestEscapeText(t *testing.T) {
+	for _, s := range []string{"", "plain ascii", `<a href="x">&'</a>`, "tab\tnew\nline", "árvíztűrő"} {
+		var got, want strings.Builder
+		if err := escapeText(&got, s); err != nil {
+			t.Fatal(err)
+		}
+		xml.EscapeText(&want, []byte(s))
+		if got.String() != want.String() {
+			t.Errorf("%q: want %q but got %q", s, want.String(), got.String())
+		}
+	}
+}
+
+func BenchmarkEscapeText(b *testing.B) {
+	for _, tc := range []struct{ name, s string }{
+		{"ascii", "metaWeblog.getRecentPosts"},
+		{"mixed", `Tom & Jerry <tom@example.com> "árvíztűrő"`},
+	} {
+		b.Run("xml/"+tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				xml.EscapeText(io.Discard, []byte(tc.s))
+			}
+		})
+		b.Run("escapeText/"+tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				escapeText(io.Discard, tc.s)
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalRequest(b *testing.B) {
+	args := []interface{}{"blog-id", "user-id", "password", 10}
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := Marshal(&buf, "metaWeblog.getRecentPosts", args...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, err := newPooledBody("metaWeblog.getRecentPosts", args...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			body.reader().Close()
+			body.release()
+		}
+	})
+}
+
+func BenchmarkCall(b *testing.B) {
+	ts := httptest.NewServer(echoServer(b))
+	defer ts.Close()
+	client := NewClient(ts.URL + "/api")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Call("Echo", "hello"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnmarshalInterning(t *testing.T) {
+	input := `<?xml version="1.0"?><methodResponse><params><param><value><array><data>` +
+		strings.Repeat(`<value><struct><member><name>status</name><value><string>active</string></value></member></struct></value>`, 2) +
+		`<value><struct><member><name>status</name><value>active</value></member></struct></value>` +
+		`</data></array></value></param></params></methodResponse>`
+	decode := func(intern bool) Array {
+		d := NewDecoder(strings.NewReader(input))
+		d.SetStringInterning(intern)
+		_, v, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v[0].(Array)
+	}
+	plain, interned := decode(false), decode(true)
+	if !reflect.DeepEqual(plain, interned) {
+		t.Fatalf("want %#v with interning but got %#v", plain, interned)
+	}
+	names := make(map[*byte]bool)
+	values := make(map[*byte]bool)
+	for _, v := range interned {
+		for name, value := range v.(Struct) {
+			names[unsafe.StringData(name)] = true
+			values[unsafe.StringData(value.(string))] = true
+		}
+	}
+	if len(names) != 1 || len(values) != 1 {
+		t.Fatalf("want shared strings but got %d names and %d values", len(names), len(values))
+	}
+}
+
+func BenchmarkUnmarshalInterning(b *testing.B) {
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0"?><methodResponse><params><param><value><array><data>`)
+	for i := 0; i < 10000; i++ {
+		buf.WriteString(`<value><struct><member><name>status</name><value><string>active</string></value></member></struct></value>`)
+	}
+	buf.WriteString(`</data></array></value></param></params></methodResponse>`)
+	input := buf.String()
+
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%t", intern), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d := NewDecoder(strings.NewReader(input))
+				d.SetStringInterning(intern)
+				if _, _, err := d.Decode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := CallContext(ctx, ts.URL, "Sleep"); err != context.DeadlineExceeded {
+		t.Fatalf("want %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := NewClient(ts.URL).CallContext(ctx, "Sleep"); err != context.Canceled {
+		t.Fatalf("want %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestMulticall(t *testing.T) {
+	ts := httptest.NewServer(createServer("/api", "system.multicall", func(args ...interface{}) (interface{}, error) {
+		var responses Array
+		for _, c := range args[0].(Array) {
+			c := c.(Struct)
+			params, _ := c["params"].(Array)
+			switch c["methodName"] {
+			case "AddInt":
+				responses = append(responses, Array{params[0].(int64) + params[1].(int64)})
+			default:
+				responses = append(responses, Struct{"faultCode": -32601, "faultString": "method not found"})
+			}
+		}
+		return responses, nil
+	}))
+	defer ts.Close()
+
+	results, errs, err := Multicall(context.Background(), ts.URL+"/api", []MethodCall{
+		{Name: "AddInt", Args: []interface{}{1, 2}},
+		{Name: "Nope"},
+		{Name: "AddInt", Args: []interface{}{3, 4}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int64(3), nil, int64(7)}; !reflect.DeepEqual(results, want) {
+		t.Fatalf("want results %#v but got %#v", want, results)
+	}
+	if errs[0] != nil || errs[2] != nil || !errors.Is(errs[1], &Fault{Code: -32601}) {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestCallRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/api", echoServer(t))
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+	})
+	for _, code := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect} {
+		path := fmt.Sprintf("/redirect%d", code)
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/api", code)
+		})
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, code := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect} {
+		v, err := NewClient(fmt.Sprintf("%s/redirect%d", ts.URL, code)).Call("Echo", "hello")
+		if err != nil {
+			t.Fatalf("%d: %v", code, err)
+		}
+		if s, _ := v[0].(string); s != "hello" {
+			t.Fatalf("%d: want %q but got %#v", code, "hello", v)
+		}
+	}
+	if _, err := Call(ts.URL+"/loop", "Echo", "hello"); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatalf("want too many redirects error but got %v", err)
+	}
+}
+
+func TestCallBuilder(t *testing.T) {
+	var attempts int
+	echo := echoServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if got := r.Header.Get("X-Api-Key"); got != "secret" {
+			http.Error(w, "bad key "+got, http.StatusForbidden)
+			return
+		}
+		echo(w, r)
+	}))
+	defer ts.Close()
+
+	v, err := NewCallBuilder().
+		Method("Echo").
+		Args("hello").
+		Header("X-Api-Key", "secret").
+		Timeout(time.Second).
+		Retry(2).
+		Backoff(ExponentialBackoff(time.Millisecond, time.Millisecond)).
+		Execute(ts.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatalf("want 3 attempts but got %d", attempts)
+	}
+	if s, _ := v[0].(string); s != "hello" {
+		t.Fatalf("want %q but got %#v", "hello", v)
+	}
+}
+
+func TestCallBuilderRetryInvalidResponse(t *testing.T) {
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Write([]byte("not xml"))
+	}))
+	defer ts.Close()
+
+	_, err := NewCallBuilder().Method("Echo").Retry(2).Execute(ts.URL)
+	if err == nil {
+		t.Fatal("want error for invalid response")
+	}
+	if attempts != 1 {
+		t.Fatalf("want 1 attempt but got %d", attempts)
+	}
+}
+
+func TestCallBuilderRetryContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NewCallBuilder().Method("Echo").Retry(5).Backoff(ExponentialBackoff(time.Hour, time.Hour)).ExecuteContext(ctx, ts.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded but got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("retries ignored the context, took %s", d)
+	}
+}
+
 func toXml(v interface{}, typ bool) (s string) {
 	var buf strings.Builder
-	if err := writeXML(&buf, v, typ); err != nil {
+	if err := NewEncoder(&buf).writeXML(v, typ); err != nil {
 		panic(err)
 	}
 	return buf.String()
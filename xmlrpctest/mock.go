@@ -0,0 +1,75 @@
+// Package xmlrpctest provides utilities for testing XML-RPC clients.
+package xmlrpctest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/mattn/go-xmlrpc"
+)
+
+// maxBodySize limits the requests accepted by a MockServer.
+const maxBodySize = 10 << 20
+
+// RecordedCall is a method call received by a MockServer.
+type RecordedCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// MockServer is an XML-RPC server answering calls with registered stubs.
+type MockServer struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]func(args []interface{}) (interface{}, *xmlrpc.Fault)
+	calls    []RecordedCall
+}
+
+// NewMockServer starts and returns a new MockServer.
+// The caller should call Close when finished, to shut it down.
+func NewMockServer() *MockServer {
+	m := &MockServer{handlers: make(map[string]func([]interface{}) (interface{}, *xmlrpc.Fault))}
+	m.srv = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+	return m
+}
+
+// Register makes the server answer calls of method with fn.
+// Calls of methods which are not registered get a -32601 fault.
+func (m *MockServer) Register(method string, fn func(args []interface{}) (interface{}, *xmlrpc.Fault)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[method] = fn
+}
+
+// URL returns the endpoint of the server.
+func (m *MockServer) URL() string { return m.srv.URL }
+
+// Calls returns the calls received so far, in order.
+func (m *MockServer) Calls() []RecordedCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RecordedCall(nil), m.calls...)
+}
+
+// Close shuts down the server.
+func (m *MockServer) Close() { m.srv.Close() }
+
+func (m *MockServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	name, args, err := xmlrpc.UnmarshalHTTPRequest(r, maxBodySize)
+	if err != nil {
+		xmlrpc.MarshalHTTPResponse(w, nil, &xmlrpc.Fault{Code: -32700, Message: err.Error()})
+		return
+	}
+	m.mu.Lock()
+	m.calls = append(m.calls, RecordedCall{Method: name, Args: args})
+	fn := m.handlers[name]
+	m.mu.Unlock()
+	if fn == nil {
+		xmlrpc.MarshalHTTPResponse(w, nil, &xmlrpc.Fault{Code: -32601, Message: "method not found: " + name})
+		return
+	}
+	result, fault := fn(args)
+	xmlrpc.MarshalHTTPResponse(w, result, fault)
+}
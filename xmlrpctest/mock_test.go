@@ -0,0 +1,94 @@
+package xmlrpctest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-xmlrpc"
+)
+
+func TestMockServer(t *testing.T) {
+	m := NewMockServer()
+	defer m.Close()
+	m.Register("add", func(args []interface{}) (interface{}, *xmlrpc.Fault) {
+		a, _ := args[0].(int64)
+		b, _ := args[1].(int64)
+		return a + b, nil
+	})
+	m.Register("fail", func(args []interface{}) (interface{}, *xmlrpc.Fault) {
+		return nil, &xmlrpc.Fault{Code: 42, Message: "failed"}
+	})
+
+	v, err := xmlrpc.Call(m.URL(), "add", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v[0] != int64(3) {
+		t.Fatalf("want 3 but got %v", v[0])
+	}
+
+	var f *xmlrpc.Fault
+	if _, err := xmlrpc.Call(m.URL(), "fail"); !errors.As(err, &f) || f.Code != 42 {
+		t.Fatalf("want fault 42 but got %v", err)
+	}
+	if _, err := xmlrpc.Call(m.URL(), "missing", "x"); !errors.As(err, &f) || f.Code != -32601 {
+		t.Fatalf("want fault -32601 but got %v", err)
+	}
+
+	want := []RecordedCall{
+		{Method: "add", Args: []interface{}{int64(1), int64(2)}},
+		{Method: "fail"},
+		{Method: "missing", Args: []interface{}{"x"}},
+	}
+	if got := m.Calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want calls %#v but got %#v", want, got)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	m := NewMockServer()
+	defer m.Close()
+	m.Register("add", func(args []interface{}) (interface{}, *xmlrpc.Fault) {
+		a, _ := args[0].(int64)
+		b, _ := args[1].(int64)
+		return a + b, nil
+	})
+
+	dir := t.TempDir()
+	client := xmlrpc.NewClient(m.URL())
+	NewRecorder(client, dir)
+	for _, args := range [][]interface{}{{1, 2}, {3, 4}} {
+		if _, err := client.Call("add", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Call("sub", 1); err == nil {
+		t.Fatal("want fault for unregistered method")
+	}
+	m.Close()
+
+	replay := NewReplayer(dir)
+	for _, want := range []int64{3, 7} {
+		v, err := replay.Call("add", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[0] != want {
+			t.Fatalf("want %d but got %v", want, v[0])
+		}
+	}
+	var f *xmlrpc.Fault
+	if _, err := replay.Call("sub", 1); !errors.As(err, &f) || f.Code != -32601 {
+		t.Fatalf("want recorded fault but got %v", err)
+	}
+	if _, err := replay.Call("add", 1, 2); err == nil {
+		t.Fatal("want error after the last recorded call")
+	}
+
+	replay = NewReplayer(dir)
+	if _, err := replay.Call("mul", 1, 2); err == nil || !strings.Contains(err.Error(), `want method "add"`) {
+		t.Fatalf("want method mismatch but got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package xmlrpctest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mattn/go-xmlrpc"
+)
+
+// Recorder saves the calls made by a Client, to be replayed by NewReplayer.
+type Recorder struct {
+	dir string
+
+	mu sync.Mutex
+	n  int
+}
+
+// NewRecorder makes client record the body of every request and response
+// into dir, as numbered files.
+func NewRecorder(client *xmlrpc.Client, dir string) *Recorder {
+	r := &Recorder{dir: dir}
+	client.Use(r.record)
+	return r
+}
+
+func (r *Recorder) record(next xmlrpc.RoundTripFunc) xmlrpc.RoundTripFunc {
+	return func(ctx context.Context, url, method string, req io.Reader) (io.ReadCloser, error) {
+		reqBody, err := io.ReadAll(req)
+		if c, ok := req.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp, err := next(ctx, url, method, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(resp)
+		resp.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.n++
+		n := r.n
+		r.mu.Unlock()
+		if err = os.WriteFile(requestFile(r.dir, n), reqBody, 0644); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(responseFile(r.dir, n), respBody, 0644); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(respBody)), nil
+	}
+}
+
+// NewReplayer returns a Client which answers calls with the responses
+// recorded into dir by a Recorder, in order. A call fails if its method
+// differs from the recorded one.
+func NewReplayer(dir string) *xmlrpc.Client {
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	client := xmlrpc.NewClient("http://replay.invalid/")
+	client.Use(func(xmlrpc.RoundTripFunc) xmlrpc.RoundTripFunc {
+		return func(ctx context.Context, url, method string, req io.Reader) (io.ReadCloser, error) {
+			if c, ok := req.(io.Closer); ok {
+				c.Close()
+			}
+			mu.Lock()
+			n++
+			i := n
+			mu.Unlock()
+			reqBody, err := os.ReadFile(requestFile(dir, i))
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("replay %d: no more recorded calls", i)
+			} else if err != nil {
+				return nil, err
+			}
+			recorded, _, err := xmlrpc.UnmarshalBytes(reqBody)
+			if err != nil {
+				return nil, fmt.Errorf("replay %d: %w", i, err)
+			}
+			if recorded != method {
+				return nil, fmt.Errorf("replay %d: want method %q, got %q", i, recorded, method)
+			}
+			respBody, err := os.ReadFile(responseFile(dir, i))
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(bytes.NewReader(respBody)), nil
+		}
+	})
+	return client
+}
+
+func requestFile(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%04d.request.xml", n))
+}
+
+func responseFile(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%04d.response.xml", n))
+}